@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates manager obtaining and renewing certificate of
+// 'host' from ACME certificate authority at 'directory' (Let's Encrypt if
+// empty). Certificates and account key are cached in 'cacheDir'. Using it
+// means accepting terms of service of the authority.
+func newACMEManager(host, cacheDir, email, directory string) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(host),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directory != "" {
+		m.Client = &acme.Client{DirectoryURL: directory}
+	}
+	return m
+}
+
+// acmeTLSConfig creates TLS configuration like serverTLSConfig does, but
+// presents certificate obtained by ACME manager. Peers are still required
+// to present pinned certificates.
+func acmeTLSConfig(m *autocert.Manager, host, peerPins string) (*tls.Config, error) {
+	pins, err := parseCertPins(peerPins)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Peers dialing by address don't send server name
+			if hello.ServerName == "" {
+				hello.ServerName = host
+			}
+			cert, err := m.GetCertificate(hello)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get ACME certificate for %s: %w", host, err)
+			}
+			return cert, nil
+		},
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: pins.verify,
+		MinVersion:            tls.VersionTLS12,
+	}, nil
+}
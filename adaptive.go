@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// adaptiveSettings configure adaptive throttling of connections
+type adaptiveSettings struct {
+	// interval is how often RTT to destinations is probed
+	interval time.Duration
+	// threshold is how many times RTT has to exceed its baseline for path to
+	// be considered congested
+	threshold float64
+	// floor is the rate connections are never throttled below
+	floor rate.Limit
+}
+
+// Rate adjustment factors. Rate is cut quickly on congestion and restored
+// gradually.
+const (
+	adaptiveDecrease = 0.7
+	adaptiveIncrease = 1.25
+)
+
+// adaptiveMinExcess is how much RTT has to exceed its baseline for path to
+// be considered congested regardless of threshold, so that jitter of very
+// short RTTs isn't taken for congestion
+const adaptiveMinExcess = 5 * time.Millisecond
+
+// adaptiveController throttles a connection while path to its destination
+// appears congested, that is while RTT stays well above the lowest RTT seen,
+// which happens once queues along the path fill up
+type adaptiveController struct {
+	settings    adaptiveSettings
+	client      string
+	destination string
+
+	mu       sync.Mutex
+	limiter  *throttle.AdaptiveLimiter
+	rtt      time.Duration
+	baseline time.Duration
+	// restoreAt is the rate connection had when it got throttled. Throttling
+	// stops once rate grows back to it.
+	restoreAt  rate.Limit
+	reductions int
+}
+
+func newAdaptiveController(settings adaptiveSettings, client, destination string) *adaptiveController {
+	return &adaptiveController{settings: settings, client: client, destination: destination}
+}
+
+// wrap returns limiter throttling connection on top of a given one
+func (a *adaptiveController) wrap(next throttle.Limiter) throttle.Limiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.limiter == nil {
+		a.limiter = throttle.NewAdaptiveLimiter(next)
+		return a.limiter
+	}
+	return a.limiter.WithNext(next)
+}
+
+// run probes RTT of a connection's socket towards destination until
+// connection is closed
+func (a *adaptiveController) run(conn *throttle.LimitedConnection, socket syscall.Conn) {
+	ticker := time.NewTicker(a.settings.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.Done():
+			return
+		case <-ticker.C:
+		}
+		rtt, err := probeRTT(socket)
+		if err != nil {
+			log.Printf("Adaptive throttling of connection from %s to %s stops: %v", a.client, a.destination, err)
+			return
+		}
+		if rtt == 0 {
+			continue
+		}
+		stats := conn.Stats()
+		a.update(rtt, rate.Limit(stats.ReadRate+stats.WriteRate))
+	}
+}
+
+// update adjusts rate to a new RTT sample given current rate of connection
+func (a *adaptiveController) update(rtt time.Duration, current rate.Limit) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rtt = rtt
+	if a.baseline == 0 || rtt < a.baseline {
+		a.baseline = rtt
+	}
+	congested := float64(rtt) > float64(a.baseline)*a.settings.threshold && rtt-a.baseline > adaptiveMinExcess
+	limit := a.limiter.Limit()
+	switch {
+	case congested:
+		if limit == rate.Inf {
+			a.restoreAt, limit = current, current
+			log.Printf("Path from %s to %s looks congested (RTT %v, baseline %v), throttling connection",
+				a.client, a.destination, rtt, a.baseline)
+		}
+		limit *= adaptiveDecrease
+		if limit < a.settings.floor {
+			limit = a.settings.floor
+		}
+		a.reductions++
+	case limit != rate.Inf:
+		limit *= adaptiveIncrease
+		if limit >= a.restoreAt {
+			limit = rate.Inf
+			log.Printf("Path from %s to %s has recovered (RTT %v), connection is no longer throttled",
+				a.client, a.destination, rtt)
+		}
+	default:
+		return
+	}
+	a.limiter.SetLimit(time.Now(), limit)
+}
+
+// adaptiveInfo is a JSON representation of adaptive throttling state of a
+// connection
+type adaptiveInfo struct {
+	// RTT and BaselineRTT are in seconds
+	RTT         float64 `json:"rtt"`
+	BaselineRTT float64 `json:"baseline_rtt"`
+	// Rate is the rate connection is throttled to. It's empty unless path
+	// is congested.
+	Rate       string `json:"rate,omitempty"`
+	Reductions int    `json:"reductions"`
+}
+
+func (a *adaptiveController) info() *adaptiveInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := &adaptiveInfo{
+		RTT:         a.rtt.Seconds(),
+		BaselineRTT: a.baseline.Seconds(),
+		Reductions:  a.reductions,
+	}
+	if a.limiter != nil {
+		if limit := a.limiter.Limit(); limit != rate.Inf {
+			res.Rate = formatRate(limit)
+		}
+	}
+	return res
+}
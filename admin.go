@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// connectionInfo is a JSON representation of a live connection served by
+// the admin API
+type connectionInfo struct {
+	ID          uint64 `json:"id"`
+	Client      string `json:"client"`
+	Tag         string `json:"tag"`
+	Destination string `json:"destination"`
+	// ASN is autonomous system of the destination if it's known
+	ASN     string    `json:"asn,omitempty"`
+	Created time.Time `json:"created"`
+	// Bytes read from and written to the destination
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+	// Total time spent waiting for the limiter, in seconds
+	WaitTime float64 `json:"wait_time"`
+	// Smoothed current rates in bytes per second
+	ReadRate  float64 `json:"read_rate"`
+	WriteRate float64 `json:"write_rate"`
+	// LimitedBy names what limits the connection: "global", "forward",
+	// "user:<tag>", "class:<name>", "rule:<position>", "sniff:<class>",
+	// "connection" if it's limited by itself, "kernel" if kernel enforces
+	// the global limit or "monitor" if traffic is only accounted
+	LimitedBy string `json:"limited_by"`
+	// Rate is the limit of whatever limits the connection, in bytes per
+	// second. It's omitted if connection is unlimited or only monitored.
+	Rate float64 `json:"rate,omitempty"`
+	// Rule is the position of the rule applied to the connection if any
+	Rule int `json:"rule,omitempty"`
+	// Adaptive is the state of adaptive throttling if it's enabled
+	Adaptive *adaptiveInfo `json:"adaptive,omitempty"`
+}
+
+// tagInfo is a JSON representation of traffic accounted for a tag
+type tagInfo struct {
+	Connections  int64   `json:"connections"`
+	BytesRead    int64   `json:"bytes_read"`
+	BytesWritten int64   `json:"bytes_written"`
+	WaitTime     float64 `json:"wait_time"`
+}
+
+// ruleInfo is a JSON representation of a rule along with the number of
+// connections it has applied to
+type ruleInfo struct {
+	Position int    `json:"position"`
+	Match    string `json:"match"`
+	Action   string `json:"action"`
+	Hits     uint64 `json:"hits"`
+}
+
+// boostRequest is a JSON request to boost global limit
+type boostRequest struct {
+	Rate     string `json:"rate"`
+	Duration string `json:"duration"`
+}
+
+// boostInfo is a JSON representation of current boost. It's empty if there
+// is no boost.
+type boostInfo struct {
+	Rate  string     `json:"rate,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// maintenanceRequest is a JSON request to put listener into maintenance
+type maintenanceRequest struct {
+	Listener string `json:"listener"`
+	// Reject is set to reject SOCKS requests rather than close connections
+	Reject bool `json:"reject"`
+}
+
+// maintenanceInfo is a JSON representation of a listener in maintenance
+type maintenanceInfo struct {
+	Listener string    `json:"listener"`
+	Reject   bool      `json:"reject"`
+	Since    time.Time `json:"since"`
+	// Connections is the number of live connections left to drain
+	Connections int `json:"connections"`
+}
+
+// newAdminHandler creates http.Handler serving admin API along with the
+// dashboard
+func newAdminHandler(registry *connRegistry, tracer *limiterTracer, metrics *delayMetrics, boost *booster, maint *maintenance, rules ruleList) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+	// Lists live connections and closes one on DELETE with its id given in
+	// query. GET lists only connections with given id or client address if
+	// either is in query, which lets clients find out how their own
+	// connections are throttled.
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		var filter func(registeredConn) bool
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			if s := query.Get("id"); s != "" {
+				id, err := strconv.ParseUint(s, 10, 64)
+				if err != nil {
+					http.Error(w, "Bad connection id", http.StatusBadRequest)
+					return
+				}
+				filter = func(c registeredConn) bool { return c.id == id }
+			} else if client := query.Get("client"); client != "" {
+				filter = func(c registeredConn) bool { return c.meta.client == client }
+			}
+		case http.MethodDelete:
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Bad connection id", http.StatusBadRequest)
+				return
+			}
+			c, ok := registry.get(id)
+			if !ok {
+				http.Error(w, "No such connection", http.StatusNotFound)
+				return
+			}
+			log.Printf("Closing connection from %s to %v by admin API client %s", c.meta.client,
+				c.conn.RemoteAddr(), r.RemoteAddr)
+			c.meta.closeReason.set(closeReasonKilled)
+			c.conn.Close()
+			if c.meta.clientConn != nil {
+				c.meta.clientConn.Close()
+			}
+		default:
+			http.Error(w, "Expected GET or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		conns := registry.list()
+		res := make([]connectionInfo, 0, len(conns))
+		for _, v := range conns {
+			if filter != nil && !filter(v) {
+				continue
+			}
+			stats := v.conn.Stats()
+			limitedBy, limit := v.meta.throttling.get()
+			if limit == rate.Inf || limitedBy == "monitor" {
+				limit = 0
+			}
+			info := connectionInfo{
+				ID:           v.id,
+				Client:       v.meta.client,
+				Tag:          v.meta.tag,
+				Destination:  v.conn.RemoteAddr().String(),
+				ASN:          formatASN(v.meta.asn, v.meta.asOrg),
+				Created:      stats.Created,
+				BytesRead:    stats.BytesRead,
+				BytesWritten: stats.BytesWritten,
+				WaitTime:     stats.WaitTime.Seconds(),
+				ReadRate:     stats.ReadRate,
+				WriteRate:    stats.WriteRate,
+				LimitedBy:    limitedBy,
+				Rate:         float64(limit),
+				Rule:         v.meta.rule,
+			}
+			if v.meta.adaptive != nil {
+				info.Adaptive = v.meta.adaptive.info()
+			}
+			res = append(res, info)
+		}
+		writeJSON(w, res)
+	})
+	mux.HandleFunc("/tags", func(w http.ResponseWriter, r *http.Request) {
+		tags := registry.tags()
+		res := make(map[string]tagInfo, len(tags))
+		for tag, totals := range tags {
+			res[tag] = tagInfo{
+				Connections:  totals.Connections,
+				BytesRead:    totals.BytesRead,
+				BytesWritten: totals.BytesWritten,
+				WaitTime:     totals.WaitTime.Seconds(),
+			}
+		}
+		writeJSON(w, res)
+	})
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		res := make([]ruleInfo, 0, len(rules))
+		for i := range rules {
+			res = append(res, ruleInfo{
+				Position: i + 1,
+				Match:    describeRuleMatch(rules[i]),
+				Action:   describeRuleAction(rules[i]),
+				Hits:     rules[i].hitCount(),
+			})
+		}
+		writeJSON(w, res)
+	})
+	// Temporarily raises global limit on POST like {"rate": "20Mbps",
+	// "duration": "10m"} and cancels boost on DELETE. Unavailable to tenants
+	// sharing the global limit.
+	mux.HandleFunc("/boost", func(w http.ResponseWriter, r *http.Request) {
+		if boost == nil {
+			http.Error(w, "Tenant shares the global limit and can't boost it", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req boostRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			limit, err := throttle.ParseRate(req.Rate)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := boost.boost(limit, d, "admin API client "+r.RemoteAddr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			boost.cancel("admin API client " + r.RemoteAddr)
+		default:
+			http.Error(w, "Expected GET, POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		var res boostInfo
+		if limit, until := boost.current(); limit != 0 {
+			res = boostInfo{Rate: formatRate(limit), Until: &until}
+		}
+		writeJSON(w, res)
+	})
+	// Puts listener into maintenance on POST like {"listener": ":1080",
+	// "reject": true} and brings it back on DELETE with listener given in
+	// query. Lists listeners in maintenance along with connections left to
+	// drain.
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req maintenanceRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := maint.enter(req.Listener, req.Reject, "admin API client "+r.RemoteAddr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case http.MethodDelete:
+			if err := maint.leave(r.URL.Query().Get("listener"), "admin API client "+r.RemoteAddr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Expected GET, POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		live := make(map[string]int)
+		for _, c := range registry.list() {
+			live[c.meta.listener]++
+		}
+		res := []maintenanceInfo{}
+		for _, addr := range maint.list() {
+			if s, ok := maint.state(addr); ok {
+				res = append(res, maintenanceInfo{Listener: addr, Reject: s.reject, Since: s.since, Connections: live[addr]})
+			}
+		}
+		writeJSON(w, res)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writePrometheus(w)
+	})
+	// Streams limiter reservations as JSON lines until client goes away.
+	// Reservations of a single connection are streamed if its id is given.
+	mux.HandleFunc("/trace", func(w http.ResponseWriter, r *http.Request) {
+		var id uint64
+		if s := r.URL.Query().Get("id"); s != "" {
+			var err error
+			if id, err = strconv.ParseUint(s, 10, 64); err != nil {
+				http.Error(w, "Bad connection id", http.StatusBadRequest)
+				return
+			}
+		}
+		events, unsubscribe := tracer.subscribe()
+		defer unsubscribe()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		for {
+			select {
+			case e := <-events:
+				if id != 0 && e.ID != id {
+					continue
+				}
+				if err := enc.Encode(e); err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write admin API response: %v", err)
+	}
+}
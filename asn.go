@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// asnDB looks up autonomous systems of destination addresses in a MaxMind
+// DB file with ASN data, like GeoLite2-ASN
+type asnDB struct {
+	reader *maxminddb.Reader
+}
+
+// asnRecord is what ASN databases hold for a network
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+func openASNDB(path string) (*asnDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open ASN database %s: %w", path, err)
+	}
+	return &asnDB{reader: reader}, nil
+}
+
+// lookup returns number and organization of autonomous system ip belongs
+// to. Zero number means it's unknown.
+func (d *asnDB) lookup(ip net.IP) (uint, string) {
+	if ip == nil {
+		return 0, ""
+	}
+	var rec asnRecord
+	if err := d.reader.Lookup(ip, &rec); err != nil {
+		return 0, ""
+	}
+	return rec.Number, rec.Organization
+}
+
+// formatASN formats autonomous system like 'AS16509 AMAZON-02'. Unknown
+// autonomous system is formatted as empty string.
+func formatASN(number uint, org string) string {
+	if number == 0 {
+		return ""
+	}
+	if org == "" {
+		return fmt.Sprintf("AS%d", number)
+	}
+	return fmt.Sprintf("AS%d %s", number, org)
+}
+
+// destinationIP returns address of the destination connection is made to
+// or nil if it's unknown, which is the case when host name is passed to an
+// upstream unresolved. 'direct' is set if conn is connected to the
+// destination itself.
+func destinationIP(host string, conn net.Conn, direct bool) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && direct {
+		return addr.IP
+	}
+	return nil
+}
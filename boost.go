@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// booster temporarily raises the global limit or a limit of a tenant.
+// Boosts don't stack: a new boost replaces the current one.
+type booster struct {
+	// name is what limit is called in the log, like 'Global limit'
+	name    string
+	limiter throttle.Limiter
+	// base is the configured limit restored once boost expires
+	base rate.Limit
+	// shaper has its rate changed along with limiter if kernel shapes the
+	// limit
+	shaper *kernelShaper
+
+	mu    sync.Mutex
+	rate  rate.Limit
+	until time.Time
+	timer *time.Timer
+}
+
+func newBooster(name string, limiter throttle.Limiter, base rate.Limit) *booster {
+	return &booster{name: name, limiter: limiter, base: base}
+}
+
+// boost sets the limit for a given duration. 'by' describes who asked
+// for the boost.
+func (b *booster) boost(limit rate.Limit, d time.Duration, by string) error {
+	if limit <= 0 || d <= 0 {
+		return fmt.Errorf("Boost rate and duration must be positive")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.setLimit(limit); err != nil {
+		return err
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.rate, b.until = limit, time.Now().Add(d)
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// Boost might have been replaced meanwhile
+		if b.timer == timer {
+			b.restoreLocked("boost expired")
+		}
+	})
+	b.timer = timer
+	log.Printf("%s boosted to %s until %s by %s", b.name, formatRate(limit),
+		b.until.Format(time.RFC3339), by)
+	return nil
+}
+
+// cancel restores configured limit right away
+func (b *booster) cancel(by string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer == nil {
+		return
+	}
+	b.timer.Stop()
+	b.restoreLocked("boost cancelled by " + by)
+}
+
+func (b *booster) restoreLocked(reason string) {
+	if err := b.setLimit(b.base); err != nil {
+		log.Printf("%s: failed to restore: %v", b.name, err)
+	}
+	b.timer, b.rate, b.until = nil, 0, time.Time{}
+	log.Printf("%s restored to %s: %s", b.name, formatRate(b.base), reason)
+}
+
+func (b *booster) setLimit(limit rate.Limit) error {
+	if err := throttle.SetLimit(b.limiter, time.Now(), limit); err != nil {
+		return err
+	}
+	if b.shaper != nil {
+		return b.shaper.setLimit(limit)
+	}
+	return nil
+}
+
+// current returns boosted limit and the time boost expires at. Zero limit
+// means there is no boost.
+func (b *booster) current() (rate.Limit, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate, b.until
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+)
+
+// sizeSuffixes are units of sizes accepted by parseSize, in powers of 1024
+var sizeSuffixes = []struct {
+	unit string
+	mul  int64
+}{
+	{unit: "KB", mul: 1024},
+	{unit: "MB", mul: 1024 * 1024},
+	{unit: "GB", mul: 1024 * 1024 * 1024},
+	{unit: "B", mul: 1},
+}
+
+// parseSize parses size like '256MB' to bytes. Number without a unit is
+// the number of bytes.
+func parseSize(s string) (int64, error) {
+	number, mul := s, int64(1)
+	for _, v := range sizeSuffixes {
+		if strings.HasSuffix(s, v.unit) {
+			number, mul = strings.TrimSuffix(s, v.unit), v.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Failed to parse size %q", s)
+	}
+	return n * mul, nil
+}
+
+// budgetListener delays accepting connections while buffer budget is
+// exhausted, so that a spike of connections doesn't get them all served
+// with buffers the host can't afford
+type budgetListener struct {
+	net.Listener
+	budget *throttle.BufferBudget
+}
+
+func (l budgetListener) Accept() (net.Conn, error) {
+	if l.budget.Used() >= l.budget.Max() {
+		log.Printf("Buffer budget of %s is exhausted, delaying new connections to %v",
+			formatBytes(l.budget.Max()), l.Addr())
+		l.budget.Wait()
+	}
+	return l.Listener.Accept()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thinkgos/go-socks5"
+)
+
+// builtinDomain is the domain of host names handled by the proxy itself
+const builtinDomain = "throttlesocks"
+
+// defaultDownloadSize is the amount of data speedtest sends unless requested
+// otherwise
+const defaultDownloadSize = 100 * 1024 * 1024
+
+// builtinService serves connections accepted on a listener
+type builtinService func(l net.Listener) error
+
+// builtinServices are services reachable through the proxy as
+// <name>.throttlesocks
+var builtinServices = map[string]builtinService{
+	"speedtest": serveSpeedtest,
+	"echo":      serveEcho,
+	"discard":   serveDiscard,
+}
+
+// startBuiltinServices starts all built-in services in-process and returns
+// their listeners keyed by host names. Services are only reachable through
+// the proxy, so that local users can't get to them bypassing limits.
+func startBuiltinServices() map[string]*builtinListener {
+	res := make(map[string]*builtinListener, len(builtinServices))
+	for name, service := range builtinServices {
+		l := newBuiltinListener(builtinHost(name))
+		name, service := name, service
+		go func() {
+			log.Printf("Built-in %s service stopped: %v", name, service(l))
+		}()
+		res[builtinHost(name)] = l
+	}
+	return res
+}
+
+func builtinHost(name string) string {
+	return name + "." + builtinDomain
+}
+
+// parseBuiltinPorts parses comma-separated list of name=address pairs of
+// built-in services exposed on side ports (for example 'echo=:7007')
+func parseBuiltinPorts(s string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Failed to parse %q, expected <service>=<address>", pair)
+		}
+		if _, ok := builtinServices[kv[0]]; !ok {
+			names := make([]string, 0, len(builtinServices))
+			for name := range builtinServices {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("Unknown built-in service %q, expected one of %s",
+				kv[0], strings.Join(names, ", "))
+		}
+		res[kv[0]] = kv[1]
+	}
+	return res, nil
+}
+
+// builtinForward creates forward from a side port to a built-in service
+func builtinForward(name, listen string) (forward, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return forward{}, err
+	}
+	return forward{listen: listen, target: net.JoinHostPort(builtinHost(name), port)}, nil
+}
+
+// builtinResolver is a socks5.NameResolver that doesn't resolve host names
+// of built-in services
+type builtinResolver struct {
+	services map[string]*builtinListener
+	next     socks5.NameResolver
+}
+
+func (r builtinResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if _, ok := r.services[name]; ok {
+		return ctx, nil, nil
+	}
+	return r.next.Resolve(ctx, name)
+}
+
+// builtinListener is a net.Listener accepting in-memory connections dialed
+// to a built-in service by the proxy
+type builtinListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newBuiltinListener(host string) *builtinListener {
+	return &builtinListener{
+		addr:  builtinAddr{host},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// dial connects to the service, waiting for it to accept connection
+func (l *builtinListener) dial() (net.Conn, error) {
+	client, server := newBuiltinPipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("Built-in service %s is stopped", l.addr)
+	}
+}
+
+func (l *builtinListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *builtinListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *builtinListener) Addr() net.Addr {
+	return l.addr
+}
+
+// builtinAddr is the address of a built-in service, which is its host name
+type builtinAddr struct {
+	host string
+}
+
+func (builtinAddr) Network() string  { return "builtin" }
+func (a builtinAddr) String() string { return a.host }
+
+// newBuiltinPipe is like net.Pipe, but its ends have loopback TCP addresses
+// and support half-close. SOCKS server only understands TCP addresses of
+// destination connections and echo relies on half-close.
+func newBuiltinPipe() (*builtinConn, *builtinConn) {
+	// Every direction has its own net.Pipe so that it can be closed
+	// independently
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	clientWriter, serverReader := net.Pipe()
+	serverWriter, clientReader := net.Pipe()
+	return &builtinConn{reader: clientReader, writer: clientWriter, addr: addr},
+		&builtinConn{reader: serverReader, writer: serverWriter, addr: addr}
+}
+
+// builtinConn is an end of a pipe created by newBuiltinPipe
+type builtinConn struct {
+	reader net.Conn
+	writer net.Conn
+	addr   net.Addr
+}
+
+func (c *builtinConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c *builtinConn) Write(b []byte) (int, error) { return c.writer.Write(b) }
+func (c *builtinConn) LocalAddr() net.Addr         { return c.addr }
+func (c *builtinConn) RemoteAddr() net.Addr        { return c.addr }
+
+// CloseWrite makes reads of the other end return io.EOF
+func (c *builtinConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *builtinConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *builtinConn) SetDeadline(t time.Time) error {
+	c.reader.SetDeadline(t)
+	return c.writer.SetDeadline(t)
+}
+
+func (c *builtinConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *builtinConn) SetWriteDeadline(t time.Time) error {
+	return c.writer.SetWriteDeadline(t)
+}
+
+// serveEcho writes back everything it reads. Once client closes its write
+// side, echo does the same after writing back the rest.
+func serveEcho(l net.Listener) error {
+	return serveEach(l, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		closeWrite(conn)
+		// Wait for client to close its side
+		io.Copy(ioutil.Discard, conn)
+	})
+}
+
+// serveDiscard reads and throws away everything
+func serveDiscard(l net.Listener) error {
+	return serveEach(l, func(conn net.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	})
+}
+
+// serveEach accepts connections and serves each of them in its own
+// goroutine, closing it afterwards
+func serveEach(l net.Listener, serve func(conn net.Conn)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			serve(conn)
+		}()
+	}
+}
+
+// serveSpeedtest serves HTTP that clients may download data from
+// (GET /download?size=<bytes>) and upload data to (POST /upload) to measure
+// their effective rate
+func serveSpeedtest(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		size := int64(defaultDownloadSize)
+		if s := r.URL.Query().Get("size"); s != "" {
+			var err error
+			size, err = strconv.ParseInt(s, 10, 64)
+			if err != nil || size < 0 {
+				http.Error(w, fmt.Sprintf("Bad size %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		io.CopyN(w, zeroReader{}, size)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "Expected POST or PUT", http.StatusMethodNotAllowed)
+			return
+		}
+		start := time.Now()
+		n, err := io.Copy(ioutil.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		elapsed := time.Since(start).Seconds()
+		writeJSON(w, map[string]float64{
+			"bytes":   float64(n),
+			"seconds": elapsed,
+			"rate":    float64(n) / elapsed,
+		})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "GET /download?size=<bytes> to measure download rate")
+		fmt.Fprintln(w, "POST /upload to measure upload rate")
+	})
+	return http.Serve(l, mux)
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves certificate loaded from files and reloads it once
+// files change or SIGHUP is received (on Unix). Only new TLS handshakes ask
+// for certificate, so established sessions keep going on the old one.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// modTimes are modification times of certificate and key files as of
+	// the last reload
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// getCertificate is a tls.Config.GetCertificate function
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload loads certificate and key. Current certificate is kept if they
+// fail to load, and they aren't retried until they change again.
+func (r *certReloader) reload() error {
+	modTimes := r.stat()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTimes = modTimes
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	return nil
+}
+
+func (r *certReloader) stat() [2]time.Time {
+	var res [2]time.Time
+	for i, name := range []string{r.certFile, r.keyFile} {
+		if fi, err := os.Stat(name); err == nil {
+			res[i] = fi.ModTime()
+		}
+	}
+	return res
+}
+
+// changed reports whether files have been modified since the last reload
+func (r *certReloader) changed() bool {
+	modTimes := r.stat()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modTimes != r.modTimes
+}
+
+// watch reloads certificate whenever files are found modified, checking
+// them every interval (unless it's zero), and upon SIGHUP
+func (r *certReloader) watch(interval time.Duration) {
+	reload := func(why string) {
+		if err := r.reload(); err != nil {
+			log.Printf("Failed to reload TLS certificate %s (%s), keeping the current one: %v", r.certFile, why, err)
+			return
+		}
+		log.Printf("Reloaded TLS certificate %s (%s)", r.certFile, why)
+	}
+	notifyReload(func() { reload("SIGHUP") })
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if r.changed() {
+				reload("files changed")
+			}
+		}
+	}()
+}
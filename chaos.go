@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// clientListener wraps accepted connections so that SOCKS requests carry
+// client connection in their remote address, which lets faults injected by
+// rules reset it
+type clientListener struct {
+	net.Listener
+}
+
+func (l clientListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return clientConn{c}, nil
+}
+
+// clientConn is a client connection accepted by clientListener. It passes
+// io.ReaderFrom, io.WriterTo and syscall.Conn of the accepted connection
+// through, so that wrapping it neither keeps data from being spliced
+// between sockets nor hides the socket from kernel shaping.
+type clientConn struct {
+	net.Conn
+}
+
+func (c clientConn) RemoteAddr() net.Addr {
+	addr := c.Conn.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+	return clientAddr{Addr: addr, conn: c.Conn}
+}
+
+func (c clientConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c clientConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{c.Conn}, r)
+}
+
+func (c clientConn) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := c.Conn.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, struct{ io.Reader }{c.Conn})
+}
+
+func (c clientConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("%T has no socket", c.Conn)
+	}
+	return sc.SyscallConn()
+}
+
+// clientAddr is the address of a client connection accepted by
+// clientListener that remembers the connection itself
+type clientAddr struct {
+	net.Addr
+	conn net.Conn
+}
+
+// abort closes connection abruptly. TCP connections send RST instead of
+// going through the normal FIN handshake.
+func abort(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
+
+// resetConn is a net.Conn wrapping connection to destination that resets
+// it along with the client connection once given time elapses or given
+// number of bytes is transferred in both directions
+type resetConn struct {
+	transferred int64
+
+	net.Conn
+	client    net.Conn
+	maxBytes  int64
+	timer     *time.Timer
+	resetOnce sync.Once
+	desc      string
+	// closeReason records that connection is reset
+	closeReason *closeReason
+}
+
+// newResetConn wraps connection to destination. If client connection is
+// unknown, client is closed by whoever relays the connection once the
+// destination is reset. Zero after or maxBytes disables the respective
+// trigger.
+func newResetConn(inner net.Conn, meta connMeta, after time.Duration, maxBytes int64) *resetConn {
+	c := &resetConn{
+		Conn:     inner,
+		client:   meta.clientConn,
+		maxBytes: maxBytes,
+		desc:     meta.client + " to " + net.JoinHostPort(meta.host, strconv.Itoa(meta.port)),
+
+		closeReason: meta.closeReason,
+	}
+	if after > 0 {
+		c.timer = time.AfterFunc(after, func() {
+			c.reset("after " + after.String())
+		})
+	}
+	return c
+}
+
+func (c *resetConn) reset(reason string) {
+	c.resetOnce.Do(func() {
+		log.Printf("Resetting connection from %s %s", c.desc, reason)
+		c.closeReason.set(closeReasonReset)
+		abort(c.Conn)
+		if c.client != nil {
+			abort(c.client)
+		}
+	})
+}
+
+// count accounts transferred bytes and resets connection once there are
+// enough of them
+func (c *resetConn) count(n int) {
+	if c.maxBytes > 0 && atomic.AddInt64(&c.transferred, int64(n)) >= c.maxBytes {
+		c.reset("after " + strconv.FormatInt(c.maxBytes, 10) + " bytes")
+	}
+}
+
+func (c *resetConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(n)
+	return n, err
+}
+
+func (c *resetConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(n)
+	return n, err
+}
+
+func (c *resetConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *resetConn) Close() error {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	return c.Conn.Close()
+}
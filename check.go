@@ -0,0 +1,228 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// runCheck runs check mode: it loads configuration the way the proxy does,
+// prints effective settings and exits with non-zero status if anything is
+// wrong, without listening or dialing anything
+func runCheck(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	var configPath = flags.String("c", "", "Path to configuration file")
+	var limit = flags.String("b", "", "Bandwidth limit the proxy is going to run with. Not checked if empty")
+	var rules ruleList
+	flags.Var(&rules, "rule", "Rule the proxy is going to run with, checked along with rules of configuration file. May be repeated")
+	flags.Parse(args)
+
+	if *configPath == "" {
+		log.Fatal("Please set configuration file")
+	}
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	link := rate.Inf
+	if *limit != "" {
+		link, err = throttle.ParseBandwidth(*limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Resolve everything the same way the proxy does
+	linkLimiter := throttle.NewLimiter(link)
+	classes := newClassSet(cfg.classes, linkLimiter)
+	rules = append(rules, cfg.rules...)
+	if err := rules.createLimiters(linkLimiter, classes); err != nil {
+		log.Fatal(err)
+	}
+	for _, forwards := range [][]forward{cfg.forwards, cfg.udpForwards} {
+		for i := range forwards {
+			if err := forwards[i].createLimiter(classes); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	for user, class := range cfg.userClasses {
+		if _, err := classes.get(class); err != nil {
+			log.Fatalf("User %q: %v", user, err)
+		}
+	}
+	p := &proxy{limiter: linkLimiter}
+	for _, t := range cfg.tenants {
+		tp, err := p.forTenant(t)
+		if err != nil {
+			log.Fatalf("Tenant %q: %v", t.name, err)
+		}
+		for _, forwards := range [][]forward{t.config.forwards, t.config.udpForwards} {
+			for i := range forwards {
+				if err := forwards[i].createLimiter(tp.classes); err != nil {
+					log.Fatalf("Tenant %q: %v", t.name, err)
+				}
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if *limit != "" {
+		fmt.Fprintf(w, "Bandwidth limit:\t%s\n\n", describeLimit(link))
+	}
+
+	fmt.Fprintf(w, "Classes:\n")
+	names := make([]string, 0, len(cfg.classes))
+	for name := range cfg.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := cfg.classes[name]
+		ceil := "-"
+		if c.ceil != 0 {
+			ceil = describeLimit(c.ceil)
+		}
+		fmt.Fprintf(w, "  %s\trate %s\tceil %s\n", name, describeLimit(c.rate), ceil)
+	}
+
+	fmt.Fprintf(w, "\nUsers:\n")
+	users := make([]string, 0, len(cfg.userClasses))
+	for user := range cfg.userClasses {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		fmt.Fprintf(w, "  %s\tclass %s\n", user, cfg.userClasses[user])
+	}
+
+	fmt.Fprintf(w, "\nRules (the first matching one applies):\n")
+	for i, r := range rules {
+		fmt.Fprintf(w, "  %d\t%s\t%s\n", i+1, describeRuleMatch(r), describeRuleAction(r))
+	}
+
+	fmt.Fprintf(w, "\nForwards:\n")
+	for _, f := range cfg.forwards {
+		fmt.Fprintf(w, "  tcp %s\t-> %s\t%s\n", f.listen, f.target, describeForwardLimit(f))
+	}
+	for _, f := range cfg.udpForwards {
+		fmt.Fprintf(w, "  udp %s\t-> %s\t%s\n", f.listen, f.target, describeForwardLimit(f))
+	}
+
+	if len(cfg.socks) > 0 {
+		fmt.Fprintf(w, "\nSOCKS listeners:\n")
+	}
+	for _, l := range cfg.socks {
+		fmt.Fprintf(w, "  %s\t%s\n", l.listen, l.describe())
+	}
+
+	if len(cfg.tenants) > 0 {
+		fmt.Fprintf(w, "\nTenants:\n")
+	}
+	for _, t := range cfg.tenants {
+		limit := "global limit"
+		if t.limit != 0 {
+			limit = "limit " + describeLimit(t.limit)
+		}
+		fmt.Fprintf(w, "  %s\tsocks %s\t%s\t%d classes, %d users, %d rules, %d forwards\n", t.name,
+			describeAddresses(socksAddresses(t.socks)), limit, len(t.config.classes), len(t.config.userClasses),
+			len(t.config.rules), len(t.config.forwards)+len(t.config.udpForwards))
+	}
+	w.Flush()
+}
+
+// describeLimit formats limit as bytes per second
+func describeLimit(l rate.Limit) string {
+	if l == rate.Inf {
+		return throttle.Unlimited
+	}
+	return fmt.Sprintf("%d B/s (%s)", int64(l), formatRate(l))
+}
+
+// describeRuleMatch formats what connections rule matches
+func describeRuleMatch(r rule) string {
+	var res []string
+	if r.host != "" {
+		res = append(res, "host "+r.host)
+	}
+	if r.maxPort != 0 {
+		port := strconv.Itoa(r.minPort)
+		if r.maxPort != r.minPort {
+			port += "-" + strconv.Itoa(r.maxPort)
+		}
+		res = append(res, "port "+port)
+	}
+	if r.user != "" {
+		res = append(res, "user "+r.user)
+	}
+	if r.asn != 0 {
+		res = append(res, fmt.Sprintf("asn AS%d", r.asn))
+	}
+	if len(res) == 0 {
+		return "any connection"
+	}
+	return strings.Join(res, ", ")
+}
+
+// describeRuleAction formats how rule handles matching connections
+func describeRuleAction(r rule) string {
+	var res []string
+	switch {
+	case r.class != "":
+		res = append(res, "class "+r.class)
+	case r.rate != 0:
+		res = append(res, "rate "+describeLimit(r.rate))
+		if r.ceil != 0 {
+			res = append(res, "ceil "+describeLimit(r.ceil))
+		}
+	default:
+		res = append(res, "global limit")
+	}
+	if r.mirror != nil {
+		res = append(res, fmt.Sprintf("mirror to %s %s", r.mirror.network, r.mirror.address))
+	}
+	if r.record != "" {
+		res = append(res, "record into "+r.record)
+	}
+	if r.resetAfter > 0 {
+		res = append(res, "reset after "+r.resetAfter.String())
+	}
+	if r.resetBytes > 0 {
+		res = append(res, fmt.Sprintf("reset after %d bytes", r.resetBytes))
+	}
+	if r.segment > 0 {
+		res = append(res, fmt.Sprintf("segment %d bytes", r.segment))
+	}
+	if r.pcap != "" {
+		res = append(res, "capture into "+r.pcap)
+	}
+	return strings.Join(res, ", ")
+}
+
+// describeForwardLimit formats how forward is limited
+func describeForwardLimit(f forward) string {
+	switch {
+	case f.class != "":
+		return "class " + f.class
+	case f.rate != 0:
+		return "rate " + describeLimit(f.rate)
+	}
+	return "global limit"
+}
+
+// describeAddresses formats a list of listen addresses
+func describeAddresses(addrs []string) string {
+	if len(addrs) == 0 {
+		return "-"
+	}
+	return strings.Join(addrs, ",")
+}
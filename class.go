@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// rateClass is a named rate declared in configuration, for example
+// `class "bulk" { rate 1Mbps; ceil 5Mbps }`. Rules, users and listeners
+// refer to classes by name.
+type rateClass struct {
+	name string
+	rate rate.Limit
+	// ceil is the limit up to which class may borrow unused link bandwidth.
+	// Zero means no borrowing.
+	ceil rate.Limit
+}
+
+// parseClass parses `class` directive
+func parseClass(d directive) (rateClass, error) {
+	var c rateClass
+	if len(d.args) != 1 {
+		return c, d.errorf("expected class name")
+	}
+	c.name = d.args[0]
+	if rateShaped(c.name) {
+		// Listeners couldn't tell such a class from their own rate
+		return c, d.errorf("class name %q looks like a rate", c.name)
+	}
+	for _, p := range d.block {
+		if len(p.args) != 1 || p.block != nil {
+			return c, p.errorf("expected a single limit")
+		}
+		l, err := throttle.ParseRate(p.args[0])
+		if err != nil {
+			return c, p.errorf("%v", err)
+		}
+		switch p.name {
+		case "rate":
+			c.rate = l
+		case "ceil":
+			c.ceil = l
+		default:
+			return c, p.errorf("unknown class parameter")
+		}
+	}
+	if c.rate == 0 {
+		return c, d.errorf("class %q has no rate", c.name)
+	}
+	if c.ceil != 0 && c.ceil < c.rate {
+		return c, d.errorf("class %q has ceil lower than rate", c.name)
+	}
+	return c, nil
+}
+
+// classSet instantiates one limiter per class that is shared by
+// everything referring to the class
+type classSet map[string]throttle.Limiter
+
+func newClassSet(classes map[string]rateClass, link throttle.Limiter) classSet {
+	res := make(classSet, len(classes))
+	for name, c := range classes {
+		res[name] = throttle.NewClassLimiter(c.rate, c.ceil, link)
+	}
+	return res
+}
+
+// get returns limiter of a class or an error if there is no such class
+func (l classSet) get(name string) (throttle.Limiter, error) {
+	res, ok := l[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown class %q", name)
+	}
+	return res, nil
+}
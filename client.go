@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/thinkgos/go-socks5"
+)
+
+// runClient runs client mode: a local SOCKS5 endpoint that forwards all
+// connections to an upstream proxy and throttles them locally
+func runClient(args []string) {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	var listenAddress = flags.String("l", "localhost:1080", "Address to listen for incoming SOCKS5 connections")
+	var upstreamURL = flags.String("upstream", "", "Upstream SOCKS5 proxy to forward connections to (for example 'socks5://gateway:1080'). socks5+tls:// upstream is another throttlesocks instance talking mutual TLS, which gets identity of original clients")
+	var upstreamCert = flags.String("upstream-cert", "", "Certificate presented to socks5+tls:// upstream")
+	var upstreamKey = flags.String("upstream-key", "", "Private key of upstream-cert")
+	var upstreamPin = flags.String("upstream-pin", "", "Comma-separated SHA-256 fingerprints of accepted socks5+tls:// upstream certificates. Required unless -upstream-ca is set")
+	var upstreamCA = flags.Bool("upstream-ca", false, "Verify socks5+tls:// upstream certificates by certificate authorities for upstream host name instead of pins, which suits upstreams using -tls-acme")
+	var limit = flags.String("b", "", "Bandwidth limit in <number><unit> format. Allowed units are TBps, Tbps, GBps, Gbps, MBps, Mbps, KBps, Kbps, Bps, bps")
+	var resolve = flags.String("resolve", resolveRemote, "Where host names requested by clients are resolved: 'local' resolves them before forwarding, 'remote' lets the upstream proxy resolve them")
+	flags.Parse(args)
+
+	if *upstreamURL == "" {
+		log.Fatal("Please set upstream")
+	}
+	if *limit == "" {
+		log.Fatal("Please set limit")
+	}
+
+	bps, err := throttle.ParseBandwidth(*limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	u, err := parseUpstream(*upstreamURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := u.setupTLS(*upstreamCert, *upstreamKey, *upstreamPin, *upstreamCA); err != nil {
+		log.Fatal(err)
+	}
+	resolver, err := newResolver(*resolve)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := &proxy{
+		limiter:  throttle.NewLimiter(bps),
+		registry: newConnRegistry(),
+		upstream: &upstreamSet{upstreams: []*upstream{u}},
+	}
+	srv := socks5.NewServer(
+		socks5.WithResolver(resolver),
+		socks5.WithRule(requestRules{}),
+		socks5.WithDial(p.socksDial))
+
+	log.Fatal(srv.ListenAndServe("tcp", *listenAddress))
+}
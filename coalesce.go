@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// coalesceSize is the amount of buffered data that is written right away
+// without waiting for coalescing delay. Writes at least that large are not
+// buffered at all.
+const coalesceSize = 16 * 1024
+
+// coalesceConn is a net.Conn that batches small writes, much like Nagle's
+// algorithm. Data is buffered until coalescing delay elapses since the
+// first buffered write or until there is enough of it. Errors of delayed
+// writes are returned by following writes.
+type coalesceConn struct {
+	net.Conn
+	delay time.Duration
+
+	mu    sync.Mutex
+	buf   []byte
+	armed bool
+	err   error
+}
+
+func newCoalesceConn(inner net.Conn, delay time.Duration) *coalesceConn {
+	return &coalesceConn{Conn: inner, delay: delay}
+}
+
+func (c *coalesceConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if len(c.buf) == 0 && len(b) >= coalesceSize {
+		return c.Conn.Write(b)
+	}
+	c.buf = append(c.buf, b...)
+	if len(c.buf) >= coalesceSize {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if !c.armed {
+		c.armed = true
+		time.AfterFunc(c.delay, func() { c.flush() })
+	}
+	return len(b), nil
+}
+
+func (c *coalesceConn) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *coalesceConn) flushLocked() error {
+	c.armed = false
+	if len(c.buf) == 0 || c.err != nil {
+		return c.err
+	}
+	_, c.err = c.Conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	return c.err
+}
+
+func (c *coalesceConn) CloseWrite() error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+// Close writes out buffered data before closing the connection
+func (c *coalesceConn) Close() error {
+	c.flush()
+	return c.Conn.Close()
+}
+
+// coalesceListener wraps accepted connections to coalesce writes to them
+type coalesceListener struct {
+	net.Listener
+	delay time.Duration
+}
+
+func (l coalesceListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newCoalesceConn(c, l.delay), nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// directive is a single configuration statement consisting of a name and
+// arguments, for example `listen :5432 -> db.internal:5432 @ 1Mbps`.
+// Directive may be followed by a block of nested directives enclosed in
+// braces. Directives are terminated by a newline, a semicolon or a block.
+type directive struct {
+	name  string
+	args  []string
+	block []directive
+	line  int
+}
+
+// errorf creates an error referring to directive location
+func (d *directive) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s: %s", d.line, d.name, fmt.Sprintf(format, args...))
+}
+
+// token is a lexical element of configuration file. Punctuation ('{', '}',
+// ';' and newline) is returned as a separate token unless it's quoted.
+type token struct {
+	text   string
+	quoted bool
+	line   int
+}
+
+func (t token) is(punct string) bool {
+	return !t.quoted && t.text == punct
+}
+
+// Splits configuration into tokens. Words are separated by whitespace,
+// double-quoted words may contain whitespace and punctuation and '#' starts
+// a comment that lasts until the end of line.
+func tokenize(r io.Reader) ([]token, error) {
+	var res []token
+	line := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		s := []rune(scanner.Text())
+		for i := 0; i < len(s); {
+			c := s[i]
+			switch {
+			case c == '#':
+				i = len(s)
+			case unicode.IsSpace(c):
+				i++
+			case c == '{' || c == '}' || c == ';':
+				res = append(res, token{text: string(c), line: line})
+				i++
+			case c == '"':
+				end := i + 1
+				for end < len(s) && s[end] != '"' {
+					end++
+				}
+				if end == len(s) {
+					return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+				}
+				res = append(res, token{text: string(s[i+1 : end]), quoted: true, line: line})
+				i = end + 1
+			default:
+				end := i
+				for end < len(s) && !unicode.IsSpace(s[end]) && !strings.ContainsRune("{};#\"", s[end]) {
+					end++
+				}
+				res = append(res, token{text: string(s[i:end]), line: line})
+				i = end
+			}
+		}
+		res = append(res, token{text: "\n", line: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// parseConfig parses configuration into a list of top-level directives
+func parseConfig(r io.Reader) ([]directive, error) {
+	tokens, err := tokenize(r)
+	if err != nil {
+		return nil, err
+	}
+	res, rest, err := parseDirectives(tokens, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("line %d: unexpected '}'", rest[0].line)
+	}
+	return res, nil
+}
+
+// Parses directives until the end of tokens or until a closing brace if
+// 'nested' is set. Returns parsed directives and remaining tokens starting
+// with the closing brace.
+func parseDirectives(tokens []token, nested bool) ([]directive, []token, error) {
+	var res []directive
+	var cur *directive
+	finish := func() {
+		if cur != nil {
+			res = append(res, *cur)
+			cur = nil
+		}
+	}
+	for len(tokens) > 0 {
+		t := tokens[0]
+		tokens = tokens[1:]
+		switch {
+		case t.is("\n") || t.is(";"):
+			finish()
+		case t.is("{"):
+			if cur == nil {
+				return nil, nil, fmt.Errorf("line %d: block without a directive", t.line)
+			}
+			block, rest, err := parseDirectives(tokens, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(rest) == 0 {
+				return nil, nil, fmt.Errorf("line %d: unterminated block of %s", t.line, cur.name)
+			}
+			cur.block = block
+			tokens = rest[1:]
+			finish()
+		case t.is("}"):
+			finish()
+			if !nested {
+				return nil, nil, fmt.Errorf("line %d: unexpected '}'", t.line)
+			}
+			return res, append([]token{t}, tokens...), nil
+		case cur == nil:
+			cur = &directive{name: t.text, line: t.line}
+		default:
+			cur.args = append(cur.args, t.text)
+		}
+	}
+	finish()
+	return res, nil, nil
+}
+
+// config is everything declared in configuration file
+type config struct {
+	forwards    []forward
+	udpForwards []forward
+	classes     map[string]rateClass
+	// userClasses maps usernames to names of their rate classes
+	userClasses map[string]string
+	rules       ruleList
+	tenants     []tenant
+	// socks are SOCKS listeners served along with the one set by flags
+	socks []socksListener
+}
+
+// newConfig interprets parsed directives
+func newConfig(directives []directive) (*config, error) {
+	c := config{
+		classes:     make(map[string]rateClass),
+		userClasses: make(map[string]string),
+	}
+	for _, d := range directives {
+		switch d.name {
+		case "class":
+			class, err := parseClass(d)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := c.classes[class.name]; ok {
+				return nil, d.errorf("class %q is already declared", class.name)
+			}
+			c.classes[class.name] = class
+		case "user":
+			if err := c.parseUser(d); err != nil {
+				return nil, err
+			}
+		case "rule":
+			r, err := parseRule(strings.Join(d.args, " "))
+			if err != nil {
+				return nil, d.errorf("%v", err)
+			}
+			c.rules = append(c.rules, r)
+		case "listen":
+			f, err := parseForward(d)
+			if err != nil {
+				return nil, err
+			}
+			c.forwards = append(c.forwards, f)
+		case "listen-udp":
+			f, err := parseForward(d)
+			if err != nil {
+				return nil, err
+			}
+			c.udpForwards = append(c.udpForwards, f)
+		case "socks":
+			l, err := parseSocksListener(d)
+			if err != nil {
+				return nil, err
+			}
+			c.socks = append(c.socks, l)
+		case "tenant":
+			t, err := parseTenant(d)
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range c.tenants {
+				if other.name == t.name {
+					return nil, d.errorf("tenant %q is already declared", t.name)
+				}
+			}
+			c.tenants = append(c.tenants, t)
+		default:
+			return nil, d.errorf("unknown directive")
+		}
+	}
+	if err := c.checkClasses(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Parses `user` directive which looks like `user "job1" { class bulk }`
+func (c *config) parseUser(d directive) error {
+	if len(d.args) != 1 {
+		return d.errorf("expected username")
+	}
+	for _, p := range d.block {
+		switch p.name {
+		case "class":
+			if len(p.args) != 1 {
+				return p.errorf("expected class name")
+			}
+			c.userClasses[d.args[0]] = p.args[0]
+		default:
+			return p.errorf("unknown user parameter")
+		}
+	}
+	return nil
+}
+
+// Makes sure that every referred class is declared
+func (c *config) checkClasses() error {
+	check := func(name string, referrer string) error {
+		if _, ok := c.classes[name]; name != "" && !ok {
+			return fmt.Errorf("%s refers to unknown class %q", referrer, name)
+		}
+		return nil
+	}
+	for user, class := range c.userClasses {
+		if err := check(class, fmt.Sprintf("user %q", user)); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.rules {
+		if err := check(r.class, "rule"); err != nil {
+			return err
+		}
+	}
+	for _, f := range append(c.forwards, c.udpForwards...) {
+		if err := check(f.class, "forward from "+f.listen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadConfig reads and interprets configuration file
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	directives, err := parseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	res, err := newConfig(directives)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return res, nil
+}
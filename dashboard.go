@@ -0,0 +1,14 @@
+package main
+
+import (
+	// Dashboard page is embedded into the binary
+	_ "embed"
+)
+
+// dashboardHTML is a single-page dashboard served at the root of admin API.
+// It polls /connections, /tags, /rules and /boost relative to its own URL,
+// so it works for tenants as well. Admin token of a tenant is taken from
+// '#token=' fragment of the page URL.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of dial failures that may be injected. Errors they fail with are
+// what SOCKS server maps to matching reply codes.
+const (
+	dialFaultRefused     = "refused"
+	dialFaultNXDomain    = "nxdomain"
+	dialFaultTimeout     = "timeout"
+	dialFaultUnreachable = "unreachable"
+)
+
+var dialFaultKinds = []string{dialFaultNXDomain, dialFaultRefused, dialFaultTimeout, dialFaultUnreachable}
+
+// dialFault is a kind of dial failure along with its probability
+type dialFault struct {
+	kind        string
+	probability float64
+}
+
+// dialFaults makes a fraction of dials fail before any bytes flow, so that
+// retries and fallbacks of clients can be tested apart from faults
+// injected into established connections
+type dialFaults struct {
+	faults []dialFault
+	// timeout is how long dials failing with timeout hang before failing
+	timeout time.Duration
+}
+
+// parseDialFaults parses comma-separated list of kind=probability pairs
+// (for example 'refused=0.05,timeout=0.01')
+func parseDialFaults(s string, timeout time.Duration) (*dialFaults, error) {
+	res := &dialFaults{timeout: timeout}
+	var total float64
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Failed to parse %q, expected <kind>=<probability>", pair)
+		}
+		i := sort.SearchStrings(dialFaultKinds, kv[0])
+		if i == len(dialFaultKinds) || dialFaultKinds[i] != kv[0] {
+			return nil, fmt.Errorf("Unknown dial fault %q, expected one of %s", kv[0], strings.Join(dialFaultKinds, ", "))
+		}
+		p, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, fmt.Errorf("Bad probability %q of dial fault %q, expected a number between 0 and 1", kv[1], kv[0])
+		}
+		total += p
+		res.faults = append(res.faults, dialFault{kind: kv[0], probability: p})
+	}
+	if total > 1 {
+		return nil, fmt.Errorf("Probabilities of dial faults add up to more than 1")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("Dial fault timeout must be positive")
+	}
+	return res, nil
+}
+
+// inject randomly picks a fault for a dial to addr and fails it. It
+// returns nil if dial should go ahead.
+func (f *dialFaults) inject(addr string, meta connMeta) error {
+	x := rand.Float64()
+	for _, fault := range f.faults {
+		if x >= fault.probability {
+			x -= fault.probability
+			continue
+		}
+		log.Printf("Injecting %s into connection from %s (tag %q) to %s", fault.kind, meta.client, meta.tag, addr)
+		host, _, _ := net.SplitHostPort(addr)
+		switch fault.kind {
+		case dialFaultNXDomain:
+			return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		case dialFaultRefused:
+			return fmt.Errorf("dial tcp %s: connect: connection refused", addr)
+		case dialFaultUnreachable:
+			return fmt.Errorf("dial tcp %s: connect: network is unreachable", addr)
+		default:
+			time.Sleep(f.timeout)
+			return fmt.Errorf("dial tcp %s: i/o timeout", addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	// Pure Go SQLite driver registered as "sqlite"
+	_ "modernc.org/sqlite"
+)
+
+// Reasons connections are closed for in flow log
+const (
+	closeReasonClosed   = "closed"
+	closeReasonLifetime = "lifetime"
+	closeReasonReset    = "reset"
+	closeReasonKilled   = "killed"
+)
+
+// closeReason remembers why the proxy closed a connection by itself. The
+// first reason set wins. Connections nobody has set a reason for are closed
+// by their clients or destinations.
+type closeReason struct {
+	mu     sync.Mutex
+	reason string
+}
+
+// set records reason unless there is one already. It is safe to call on
+// nil closeReason.
+func (c *closeReason) set(reason string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+}
+
+func (c *closeReason) get() string {
+	if c == nil {
+		return closeReasonClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reason == "" {
+		return closeReasonClosed
+	}
+	return c.reason
+}
+
+// flowLogSchema creates table of finished connections. Times are RFC 3339
+// strings, rates are in bytes per second and wait time is in seconds.
+const flowLogSchema = `CREATE TABLE IF NOT EXISTS flows (
+	id INTEGER PRIMARY KEY,
+	start TEXT NOT NULL,
+	end TEXT NOT NULL,
+	client TEXT NOT NULL,
+	user TEXT NOT NULL,
+	destination TEXT NOT NULL,
+	listener TEXT NOT NULL,
+	bytes_read INTEGER NOT NULL,
+	bytes_written INTEGER NOT NULL,
+	read_rate REAL NOT NULL,
+	write_rate REAL NOT NULL,
+	wait_time REAL NOT NULL,
+	close_reason TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS flows_start ON flows (start);`
+
+// flowLog writes a row for every finished connection into a SQLite
+// database
+type flowLog struct {
+	db     *sql.DB
+	insert *sql.Stmt
+}
+
+// openFlowLog opens SQLite database at path creating it and its table if
+// needed
+func openFlowLog(path string) (*flowLog, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite doesn't write concurrently anyway, and a single connection
+	// never gets SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(flowLogSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to create flow log in %s: %w", path, err)
+	}
+	insert, err := db.Prepare(`INSERT INTO flows (start, end, client, user, destination, listener,
+		bytes_read, bytes_written, read_rate, write_rate, wait_time, close_reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &flowLog{db: db, insert: insert}, nil
+}
+
+// record writes a row for connection that has finished at 'end'
+func (f *flowLog) record(meta connMeta, stats throttle.ConnectionStats, end time.Time) {
+	var readRate, writeRate float64
+	if elapsed := end.Sub(stats.Created).Seconds(); elapsed > 0 {
+		readRate = float64(stats.BytesRead) / elapsed
+		writeRate = float64(stats.BytesWritten) / elapsed
+	}
+	key := meta.usageKey()
+	_, err := f.insert.Exec(stats.Created.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano),
+		meta.client, meta.tag, key.destination, meta.listener, stats.BytesRead, stats.BytesWritten,
+		readRate, writeRate, stats.WaitTime.Seconds(), meta.closeReason.get())
+	if err != nil {
+		log.Printf("Failed to write flow log: %v", err)
+	}
+}
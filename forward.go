@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// forward is a static TCP or UDP forward from a local address to a fixed
+// destination
+type forward struct {
+	listen string
+	target string
+	// rate is the limit shared by all connections of the forward
+	rate rate.Limit
+	// class is the name of a rate class used instead of rate
+	class string
+	// limiter is created by createLimiter. If nil, global limiter is used.
+	limiter throttle.Limiter
+}
+
+// parseForward parses forward from `listen` or `listen-udp` directive
+// arguments which look like `:5432 -> db.internal:5432 @ 1Mbps`. Rate part
+// is optional and may refer to a rate class by name instead unless it looks
+// like a rate, so that a rate with a typo isn't mistaken for a class.
+func parseForward(d directive) (forward, error) {
+	var f forward
+	args := d.args
+	if d.block != nil {
+		return f, d.errorf("unexpected block")
+	}
+	if len(args) != 3 && len(args) != 5 {
+		return f, d.errorf("expected '<address> -> <target> [@ <rate>]'")
+	}
+	if args[1] != "->" {
+		return f, d.errorf("expected '->' after listen address")
+	}
+	f.listen, f.target = args[0], args[2]
+	if _, _, err := net.SplitHostPort(f.target); err != nil {
+		return f, d.errorf("bad target %q: %v", f.target, err)
+	}
+	if len(args) == 5 {
+		if args[3] != "@" {
+			return f, d.errorf("expected '@' before rate")
+		}
+		if !rateShaped(args[4]) {
+			f.class = args[4]
+			return f, nil
+		}
+		l, err := throttle.ParseRate(args[4])
+		if err != nil {
+			return f, d.errorf("bad rate %q: %v", args[4], err)
+		}
+		f.rate = l
+	}
+	return f, nil
+}
+
+// rateShaped tells whether forward's rate part is meant to be a rate rather
+// than a class name, which is the case if it starts with a number or is
+// 'unlimited'. Class names can't look like that.
+func rateShaped(s string) bool {
+	if s == throttle.Unlimited {
+		return true
+	}
+	return s != "" && (s[0] >= '0' && s[0] <= '9' || s[0] == '.')
+}
+
+// createLimiter creates forward's limiter or looks up limiter of its class
+func (f *forward) createLimiter(classes classSet) error {
+	switch {
+	case f.rate != 0:
+		f.limiter = throttle.NewLimiter(f.rate)
+	case f.class != "":
+		limiter, err := classes.get(f.class)
+		if err != nil {
+			return fmt.Errorf("Forward from %s: %w", f.listen, err)
+		}
+		f.limiter = limiter
+	}
+	return nil
+}
+
+// serveForward accepts connections on forward's listener and relays them to
+// its target
+func (p *proxy) serveForward(l net.Listener, f forward) error {
+	defer l.Close()
+
+	host, portString, _ := net.SplitHostPort(f.target)
+	port, _ := strconv.Atoi(portString)
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			meta := connMeta{client: client.RemoteAddr().String(), host: host, port: port, listener: f.listen, clientConn: client}
+			if p.coalesce > 0 {
+				client = newCoalesceConn(client, p.coalesce)
+			}
+			defer client.Close()
+			logAccepted.Printf("Connection from %s to %s forwarded to %s", meta.client, f.listen, f.target)
+			target, err := p.dial("tcp", f.target, meta, f.limiter)
+			if err != nil {
+				log.Printf("Failed to forward %s to %s: %v", f.listen, f.target, err)
+				return
+			}
+			defer target.Close()
+			relay(client, target)
+		}()
+	}
+}
+
+// closeWriter is implemented by connections that support half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down writing side of connection if it supports that
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("Half-close is not supported by %T", c)
+}
+
+// relay copies data between two connections in both directions. Once one
+// direction reaches EOF, writing side of its destination is closed and relay
+// waits for the other direction. If that's impossible or copying fails,
+// relay returns right away.
+func relay(a, b net.Conn) {
+	halfClosed := make(chan bool, 2)
+	copyAndSignal := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		halfClosed <- err == nil && closeWrite(dst) == nil
+	}
+	go copyAndSignal(a, b)
+	go copyAndSignal(b, a)
+	if <-halfClosed {
+		<-halfClosed
+	}
+}
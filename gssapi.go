@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/thinkgos/go-socks5"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// SOCKS5 GSSAPI authentication (RFC 1961)
+const (
+	gssapiMethod  = 0x01
+	gssapiVersion = 0x01
+	// Message types
+	gssapiAuthentication = 0x01
+	gssapiProtection     = 0x02
+	gssapiAbort          = 0xff
+	// gssapiClear is the protection level without per-message protection
+	gssapiClear = 0x00
+)
+
+// gssMutualFlag is set in checksum of Kerberos authenticator when client
+// requests mutual authentication (RFC 4121)
+const gssMutualFlag = 2
+
+// gssapiAuthenticator is a socks5.Authenticator that authenticates clients
+// with their Kerberos tickets and tags connections with client principal
+// (for example 'alice@EXAMPLE.COM'). Only encryption types of RFC 4121 (AES)
+// are supported. Per-message protection isn't offered, so that data is
+// relayed as is once client is authenticated.
+type gssapiAuthenticator struct {
+	settings *service.Settings
+}
+
+// newGSSAPIAuthenticator creates authenticator accepting tickets for
+// service principal given in keytab. If principal is empty, any principal
+// in keytab is accepted.
+func newGSSAPIAuthenticator(keytabPath, principal string) (*gssapiAuthenticator, error) {
+	kt, err := keytab.Load(keytabPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load keytab %s: %w", keytabPath, err)
+	}
+	settings := []func(*service.Settings){service.DecodePAC(false)}
+	if principal != "" {
+		settings = append(settings, service.KeytabPrincipal(principal))
+	}
+	return &gssapiAuthenticator{settings: service.NewSettings(kt, settings...)}, nil
+}
+
+func (a *gssapiAuthenticator) GetCode() uint8 {
+	return gssapiMethod
+}
+
+func (a *gssapiAuthenticator) Authenticate(reader io.Reader, writer io.Writer, userAddr string) (*socks5.AuthContext, error) {
+	if _, err := writer.Write([]byte{statute.VersionSocks5, gssapiMethod}); err != nil {
+		return nil, err
+	}
+	user, err := a.negotiate(reader, writer)
+	if err != nil {
+		writer.Write([]byte{gssapiVersion, gssapiAbort})
+		log.Printf("GSSAPI authentication of %s failed: %v", userAddr, err)
+		return nil, err
+	}
+	return &socks5.AuthContext{
+		Method:  gssapiMethod,
+		Payload: map[string]string{"username": user},
+	}, nil
+}
+
+// negotiate establishes security context with client and agrees on
+// protection level. Returns client principal.
+func (a *gssapiAuthenticator) negotiate(reader io.Reader, writer io.Writer) (string, error) {
+	token, err := readGSSAPIMessage(reader, gssapiAuthentication)
+	if err != nil {
+		return "", err
+	}
+	var krb5Token spnego.KRB5Token
+	if err := krb5Token.Unmarshal(token); err != nil {
+		return "", err
+	}
+	if !krb5Token.IsAPReq() {
+		return "", fmt.Errorf("Expected AP-REQ token")
+	}
+	req := &krb5Token.APReq
+	ok, creds, err := service.VerifyAPREQ(req, a.settings)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("Ticket is not valid")
+	}
+	if mutualRequested(req) {
+		rep, err := newAPRepToken(req)
+		if err != nil {
+			return "", err
+		}
+		if err := writeGSSAPIMessage(writer, gssapiAuthentication, rep); err != nil {
+			return "", err
+		}
+	}
+
+	// Whatever client asks for, it gets no per-message protection. Clients
+	// compatible with NEC implementation send protection level unwrapped.
+	key := req.Ticket.DecryptedEncPart.Key
+	if req.Authenticator.SubKey.KeyType != 0 {
+		key = req.Authenticator.SubKey
+	}
+	token, err = readGSSAPIMessage(reader, gssapiProtection)
+	if err != nil {
+		return "", err
+	}
+	reply := []byte{gssapiClear}
+	if len(token) != 1 {
+		if err := verifyWrapToken(token, key); err != nil {
+			return "", err
+		}
+		if reply, err = newAcceptorWrapToken(reply, key); err != nil {
+			return "", err
+		}
+	}
+	if err := writeGSSAPIMessage(writer, gssapiProtection, reply); err != nil {
+		return "", err
+	}
+	return creds.CName().PrincipalNameString() + "@" + creds.Realm(), nil
+}
+
+// readGSSAPIMessage reads a message of given type and returns its token
+func readGSSAPIMessage(r io.Reader, mtyp byte) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != gssapiVersion {
+		return nil, fmt.Errorf("Unsupported GSSAPI message version %d", header[0])
+	}
+	if header[1] != mtyp {
+		return nil, fmt.Errorf("Unexpected GSSAPI message type %d", header[1])
+	}
+	token := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func writeGSSAPIMessage(w io.Writer, mtyp byte, token []byte) error {
+	if len(token) > 0xffff {
+		return fmt.Errorf("GSSAPI token is too long")
+	}
+	msg := []byte{gssapiVersion, mtyp, 0, 0}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	_, err := w.Write(append(msg, token...))
+	return err
+}
+
+// mutualRequested reports whether client expects AP-REP
+func mutualRequested(req *messages.APReq) bool {
+	if types.IsFlagSet(&req.APOptions, flags.APOptionMutualRequired) {
+		return true
+	}
+	cksum := req.Authenticator.Cksum.Checksum
+	return len(cksum) >= 24 && binary.LittleEndian.Uint32(cksum[20:24])&gssMutualFlag != 0
+}
+
+// encAPRepPart is the encrypted part of AP-REP without subkey, which gokrb5
+// is only able to unmarshal
+type encAPRepPart struct {
+	CTime          time.Time `asn1:"generalized,explicit,tag:0"`
+	Cusec          int       `asn1:"explicit,tag:1"`
+	SequenceNumber int64     `asn1:"optional,explicit,tag:3"`
+}
+
+// newAPRepToken creates GSSAPI token with AP-REP replying to given AP-REQ
+func newAPRepToken(req *messages.APReq) ([]byte, error) {
+	var seq [4]byte
+	if _, err := rand.Read(seq[:]); err != nil {
+		return nil, err
+	}
+	part, err := asn1.Marshal(encAPRepPart{
+		CTime:          req.Authenticator.CTime,
+		Cusec:          req.Authenticator.Cusec,
+		SequenceNumber: int64(binary.BigEndian.Uint32(seq[:]) & 0x3fffffff),
+	})
+	if err != nil {
+		return nil, err
+	}
+	part = asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart)
+	encPart, err := crypto.GetEncryptedData(part, req.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+	rep, err := asn1.Marshal(messages.APRep{
+		PVNO:    iana.PVNO,
+		MsgType: msgtype.KRB_AP_REP,
+		EncPart: encPart,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rep = asn1tools.AddASNAppTag(rep, asnAppTag.APREP)
+
+	token, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+	token = append(token, 0x02, 0x00)
+	token = append(token, rep...)
+	return asn1tools.AddASNAppTag(token, 0), nil
+}
+
+// Wrap token flags (RFC 4121)
+const (
+	wrapSentByAcceptor = 0x01
+	wrapSealed         = 0x02
+)
+
+// verifyWrapToken checks integrity of wrap token sent by client
+func verifyWrapToken(b []byte, key types.EncryptionKey) error {
+	var wt gssapi.WrapToken
+	if len(b) > gssapi.HdrLen {
+		// Undo rotation of everything following the header
+		rrc := int(binary.BigEndian.Uint16(b[6:8]))
+		body := b[gssapi.HdrLen:]
+		rrc %= len(body)
+		b = append(b[:gssapi.HdrLen:gssapi.HdrLen], append(body[rrc:], body[:rrc]...)...)
+	}
+	if err := wt.Unmarshal(b, false); err != nil {
+		return err
+	}
+	if wt.Flags&wrapSealed != 0 {
+		return fmt.Errorf("Confidentiality is not supported")
+	}
+	_, err := wt.Verify(key, keyusage.GSSAPI_INITIATOR_SEAL)
+	return err
+}
+
+// newAcceptorWrapToken wraps payload with integrity protection
+func newAcceptorWrapToken(payload []byte, key types.EncryptionKey) ([]byte, error) {
+	etype, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	wt := gssapi.WrapToken{
+		Flags:   wrapSentByAcceptor,
+		EC:      uint16(etype.GetHMACBitLength() / 8),
+		Payload: payload,
+	}
+	if err := wt.SetCheckSum(key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+		return nil, err
+	}
+	return wt.Marshal()
+}
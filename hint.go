@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// parseRateHint splits SOCKS username like 'job1;rate=256Kbps' into tag and
+// rate of the connection requested by client. Rate is zero if username has
+// no hint.
+func parseRateHint(username string) (string, rate.Limit, error) {
+	parts := strings.Split(username, ";")
+	var limit rate.Limit
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[0] != "rate" {
+			return "", 0, fmt.Errorf("Bad hint %q in username %q, expected rate=<limit>", part, username)
+		}
+		l, err := throttle.ParseRate(kv[1])
+		if err != nil {
+			return "", 0, err
+		}
+		limit = l
+	}
+	return parts[0], limit, nil
+}
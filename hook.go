@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+)
+
+// hookTimeout limits how long a hook command may run
+const hookTimeout = 5 * time.Second
+
+// hook is an external command consulted about connections. It receives a
+// JSON object on stdin and prints a JSON decision like
+// {"allow": true, "rate": "1Mbps", "class": "bulk"} to stdout. Connection
+// is rejected if the command fails or doesn't allow it explicitly.
+type hook struct {
+	name string
+	args []string
+}
+
+// hookDecision is a decision printed by hook command
+type hookDecision struct {
+	Allow bool   `json:"allow"`
+	Rate  string `json:"rate"`
+	Class string `json:"class"`
+}
+
+// newHook creates a hook running given command line. Command line is split
+// into arguments on white space.
+func newHook(command string) (*hook, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Empty hook command")
+	}
+	return &hook{name: args[0], args: args[1:]}, nil
+}
+
+func (h *hook) String() string {
+	return "hook " + h.name
+}
+
+// run runs hook command with input encoded to its stdin
+func (h *hook) run(input interface{}) (hookDecision, error) {
+	var decision hookDecision
+	in, err := json.Marshal(input)
+	if err != nil {
+		return decision, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.name, h.args...)
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return decision, fmt.Errorf("Hook %s failed: %w (%s)", h.name, err, strings.TrimSpace(stderr.String()))
+	}
+	if err := json.Unmarshal(out, &decision); err != nil {
+		return decision, fmt.Errorf("Failed to decode decision of hook %s: %w", h.name, err)
+	}
+	return decision, nil
+}
+
+// decide runs hook for a SOCKS connection. Input is the same as the one of
+// policy engine.
+func (h *hook) decide(meta connMeta) (connDecision, error) {
+	var decision connDecision
+	res, err := h.run(policyInput{Client: meta.client, User: meta.tag, Host: meta.host, Port: meta.port})
+	if err != nil {
+		return decision, err
+	}
+	decision.allow = res.Allow
+	decision.class = res.Class
+	if res.Rate != "" {
+		decision.rate, err = throttle.ParseRate(res.Rate)
+		if err != nil {
+			return decision, fmt.Errorf("Hook %s returned bad rate: %w", h.name, err)
+		}
+	}
+	return decision, nil
+}
+
+// hookCredentials is a socks5.CredentialStore that lets hook decide whether
+// credentials are valid. Hook receives client, user and password fields.
+type hookCredentials struct {
+	hook *hook
+}
+
+func (c hookCredentials) Valid(user, password, userAddr string) bool {
+	res, err := c.hook.run(map[string]string{"client": userAddr, "user": user, "password": password})
+	if err != nil {
+		log.Printf("Rejecting authentication of %s (user %q): %v", userAddr, user, err)
+		return false
+	}
+	if !res.Allow {
+		logRejected.Printf("Rejecting authentication of %s (user %q): denied by %s", userAddr, user, c.hook)
+	}
+	return res.Allow
+}
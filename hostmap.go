@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/thinkgos/go-socks5"
+	"github.com/thinkgos/go-socks5/statute"
+)
+
+// hostMap maps requested host names (or IP addresses) to replacement
+// destinations. Replacement is either a host or host:port.
+type hostMap map[string]string
+
+// parseHostMap parses comma-separated list of from=to pairs, for example
+// "example.com=10.0.0.5,api.test=staging.internal:8443"
+func parseHostMap(s string) (hostMap, error) {
+	res := make(hostMap)
+	for _, pair := range strings.Split(s, ",") {
+		eq := strings.IndexByte(pair, '=')
+		if eq <= 0 || eq == len(pair)-1 {
+			return nil, fmt.Errorf("Failed to parse %q: expected host=destination", pair)
+		}
+		from, to := pair[:eq], pair[eq+1:]
+		if _, port, err := net.SplitHostPort(to); err == nil {
+			if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				return nil, fmt.Errorf("Bad port in %q", pair)
+			}
+		}
+		res[from] = to
+	}
+	return res, nil
+}
+
+// destination returns replacement address for a requested one or nil if
+// requested host isn't mapped
+func (m hostMap) destination(host string, port int) *statute.AddrSpec {
+	to, ok := m[host]
+	if !ok {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(to); err != nil {
+		to = net.JoinHostPort(to, strconv.Itoa(port))
+	}
+	spec, err := statute.ParseAddrSpec(to)
+	if err != nil {
+		return nil
+	}
+	return &spec
+}
+
+// mappingResolver is a socks5.NameResolver that doesn't resolve mapped host
+// names since they are going to be replaced anyway
+type mappingResolver struct {
+	hosts hostMap
+	next  socks5.NameResolver
+}
+
+func (r mappingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if _, ok := r.hosts[name]; ok {
+		return ctx, nil, nil
+	}
+	return r.next.Resolve(ctx, name)
+}
+
+// mappingRewriter is a socks5.AddressRewriter replacing destinations of
+// mapped hosts
+type mappingRewriter struct {
+	hosts hostMap
+}
+
+func (r mappingRewriter) Rewrite(ctx context.Context, req *socks5.Request) (context.Context, *statute.AddrSpec) {
+	if dest := r.hosts.destination(requestHost(req), requestPort(req)); dest != nil {
+		return ctx, dest
+	}
+	return ctx, req.DestAddr
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// link describes network conditions emulated between the proxy and
+// destinations on top of bandwidth limits
+type link struct {
+	// latency is one-way delay added to data in each direction
+	latency time.Duration
+	// jitter is the maximum random deviation from latency
+	jitter time.Duration
+	// loss is the probability of losing a segment or a datagram. Lost TCP
+	// segments are retransmitted, which is emulated by a stall.
+	loss float64
+	// Probabilities of duplicating and reordering a datagram. Reordered
+	// datagrams are held for a random time up to reorderDelay so that
+	// following ones overtake them. TCP connections are not affected.
+	duplicate    float64
+	reorder      float64
+	reorderDelay time.Duration
+}
+
+// linkProfile is a named preset of link conditions
+type linkProfile struct {
+	limit string
+	link  link
+}
+
+// linkProfiles are presets selectable with -profile
+var linkProfiles = map[string]linkProfile{
+	"3g":        {limit: "1500Kbps", link: link{latency: 100 * time.Millisecond, jitter: 30 * time.Millisecond, loss: 0.01}},
+	"4g":        {limit: "20Mbps", link: link{latency: 30 * time.Millisecond, jitter: 10 * time.Millisecond, loss: 0.001}},
+	"dsl":       {limit: "8Mbps", link: link{latency: 15 * time.Millisecond, jitter: 3 * time.Millisecond, loss: 0.0005}},
+	"satellite": {limit: "10Mbps", link: link{latency: 300 * time.Millisecond, jitter: 50 * time.Millisecond, loss: 0.005}},
+}
+
+// linkProfileNames returns sorted names of link profiles
+func linkProfileNames() string {
+	names := make([]string, 0, len(linkProfiles))
+	for name := range linkProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// minRetransmitTimeout is the smallest stall emulating retransmission of a
+// lost TCP segment
+const minRetransmitTimeout = 200 * time.Millisecond
+
+// enabled reports whether link affects datagrams
+func (l link) enabled() bool {
+	return l.streams() || l.duplicate > 0 || l.reorder > 0
+}
+
+// streams reports whether link affects TCP connections
+func (l link) streams() bool {
+	return l.latency > 0 || l.jitter > 0 || l.loss > 0
+}
+
+func (l link) validate() error {
+	if l.latency < 0 || l.jitter < 0 || l.reorderDelay < 0 {
+		return fmt.Errorf("Latency, jitter and reorder delay can't be negative")
+	}
+	if l.loss < 0 || l.loss >= 1 {
+		return fmt.Errorf("Loss must be at least 0 and less than 1")
+	}
+	if l.duplicate < 0 || l.duplicate > 1 || l.reorder < 0 || l.reorder > 1 {
+		return fmt.Errorf("Duplicate and reorder must be between 0 and 1")
+	}
+	if l.reorder > 0 && l.reorderDelay == 0 {
+		return fmt.Errorf("Reorder requires reorder delay")
+	}
+	return nil
+}
+
+// chance randomly returns true with probability p
+func chance(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
+
+// lost randomly decides whether a segment or a datagram is lost
+func (l link) lost() bool {
+	return chance(l.loss)
+}
+
+// delay returns random delay of a single datagram
+func (l link) delay() time.Duration {
+	d := l.latency
+	if l.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(2*l.jitter))) - l.jitter
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// segmentDelay returns random delay of a TCP segment taking retransmission
+// of lost ones into account
+func (l link) segmentDelay() time.Duration {
+	d := l.delay()
+	if l.lost() {
+		rto := 2 * (l.latency + l.jitter)
+		if rto < minRetransmitTimeout {
+			rto = minRetransmitTimeout
+		}
+		d += rto
+	}
+	return d
+}
+
+// deliver runs send after datagram delay unless datagram is lost. Datagram
+// may be duplicated or held longer to get reordered. Without emulated
+// conditions send runs right away.
+func (l link) deliver(send func()) {
+	if !l.enabled() {
+		send()
+		return
+	}
+	if l.lost() {
+		return
+	}
+	copies := 1
+	if chance(l.duplicate) {
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		d := l.delay()
+		if chance(l.reorder) {
+			d += time.Duration(rand.Int63n(int64(l.reorderDelay))) + 1
+		}
+		time.AfterFunc(d, send)
+	}
+}
+
+// linkQueueSize is the number of chunks that may be in flight in each
+// direction of a linkConn before writes block
+const linkQueueSize = 64
+
+// linkCloseTimeout limits how long closed linkConn keeps delivering data
+// written before close
+const linkCloseTimeout = 5 * time.Second
+
+// linkChunk is data in flight through an emulated link
+type linkChunk struct {
+	data []byte
+	err  error
+	at   time.Time
+	// closeWrite is set for a chunk that closes writing side
+	closeWrite bool
+}
+
+// linkConn is a net.Conn wrapping connection to destination that delivers
+// data in both directions with emulated latency, jitter and loss. Order of
+// data is preserved. Deadlines are handled by linkConn itself.
+type linkConn struct {
+	net.Conn
+	link link
+
+	reads   chan linkChunk
+	pending []byte
+	readErr error
+
+	writes chan linkChunk
+
+	mu            sync.Mutex
+	writeErr      error
+	lastWrite     time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLinkConn(inner net.Conn, l link) *linkConn {
+	c := &linkConn{
+		Conn:   inner,
+		link:   l,
+		reads:  make(chan linkChunk, linkQueueSize),
+		writes: make(chan linkChunk, linkQueueSize),
+		done:   make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.writeLoop()
+	return c
+}
+
+// Reads from inner connection and schedules delivery of read data
+func (c *linkConn) readLoop() {
+	var last time.Time
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := c.Conn.Read(buf)
+		last = later(last, time.Now().Add(c.link.segmentDelay()))
+		select {
+		case c.reads <- linkChunk{data: buf[:n], err: err, at: last}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Writes chunks to inner connection once they are due. Chunks written
+// before close are still delivered, then inner connection gets closed.
+func (c *linkConn) writeLoop() {
+	defer c.Conn.Close()
+	for {
+		var chunk linkChunk
+		select {
+		case chunk = <-c.writes:
+		case <-c.done:
+			select {
+			case chunk = <-c.writes:
+			default:
+				return
+			}
+		}
+		time.Sleep(time.Until(chunk.at))
+		if c.failed() != nil {
+			continue
+		}
+		var err error
+		if chunk.closeWrite {
+			err = closeWrite(c.Conn)
+		} else {
+			_, err = c.Conn.Write(chunk.data)
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.writeErr = err
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *linkConn) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeErr
+}
+
+// later returns the later of two times
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// deadlineTimer returns a channel firing at deadline or nil if deadline is
+// zero
+func deadlineTimer(deadline time.Time) (<-chan time.Time, func() bool) {
+	if deadline.IsZero() {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(time.Until(deadline))
+	return t.C, t.Stop
+}
+
+func (c *linkConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 && c.readErr == nil {
+		c.mu.Lock()
+		deadline, stop := deadlineTimer(c.readDeadline)
+		c.mu.Unlock()
+		defer stop()
+		var chunk linkChunk
+		select {
+		case chunk = <-c.reads:
+		case <-deadline:
+			return 0, timeoutError{}
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		}
+		due := time.NewTimer(time.Until(chunk.at))
+		defer due.Stop()
+		select {
+		case <-due.C:
+		case <-c.done:
+			return 0, io.ErrClosedPipe
+		}
+		c.pending, c.readErr = chunk.data, chunk.err
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 && c.readErr != nil {
+		return n, c.readErr
+	}
+	return n, nil
+}
+
+// enqueue schedules chunk for writing
+func (c *linkConn) enqueue(chunk linkChunk) error {
+	c.mu.Lock()
+	if c.writeErr != nil {
+		c.mu.Unlock()
+		return c.writeErr
+	}
+	c.lastWrite = later(c.lastWrite, time.Now().Add(c.link.segmentDelay()))
+	chunk.at = c.lastWrite
+	deadline, stop := deadlineTimer(c.writeDeadline)
+	c.mu.Unlock()
+	defer stop()
+	select {
+	case <-c.done:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case c.writes <- chunk:
+		return nil
+	case <-deadline:
+		return timeoutError{}
+	case <-c.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *linkConn) Write(b []byte) (int, error) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	if err := c.enqueue(linkChunk{data: data}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *linkConn) CloseWrite() error {
+	if _, ok := c.Conn.(closeWriter); !ok {
+		return fmt.Errorf("Half-close is not supported by %T", c.Conn)
+	}
+	return c.enqueue(linkChunk{closeWrite: true})
+}
+
+func (c *linkConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *linkConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *linkConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// Close stops reading right away. Data written before close is still
+// delivered for up to linkCloseTimeout.
+func (c *linkConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.SetDeadline(time.Now().Add(linkCloseTimeout))
+	})
+	return nil
+}
+
+// timeoutError is returned by linkConn operations exceeding deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "deadline exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
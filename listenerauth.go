@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/thinkgos/go-socks5"
+)
+
+// Authentication methods of SOCKS listeners declared in configuration
+const (
+	// socksAuthNone accepts everyone without authentication
+	socksAuthNone = "none"
+	// socksAuthPassword accepts users listed with their passwords
+	socksAuthPassword = "password"
+	// socksAuthPAM accepts users whose credentials are valid for a PAM
+	// service
+	socksAuthPAM = "pam"
+	// socksAuthTLS accepts peers presenting pinned certificates over mutual
+	// TLS and trusts identity of their clients
+	socksAuthTLS = "tls"
+)
+
+// socksListener is a SOCKS listener declared in configuration, for example
+// `socks 192.168.1.10:1081 { auth password; password "alice" "s3cret" }`.
+// Listener that doesn't set authentication method follows the global
+// authentication policy set by command line flags.
+type socksListener struct {
+	listen string
+	// auth is the authentication method of the listener. Empty if listener
+	// follows the global policy.
+	auth string
+	// passwords maps usernames accepted by password authentication to their
+	// passwords
+	passwords map[string]string
+	// pamService validates credentials of PAM authentication
+	pamService string
+	// Certificate, key and pinned peer fingerprints of TLS authentication
+	tlsCert  string
+	tlsKey   string
+	tlsPeers string
+}
+
+// parseSocksListener parses `socks` directive. Its optional block sets
+// authentication of the listener.
+func parseSocksListener(d directive) (socksListener, error) {
+	var res socksListener
+	if len(d.args) != 1 {
+		return res, d.errorf("expected listen address")
+	}
+	res.listen = d.args[0]
+	for _, p := range d.block {
+		switch p.name {
+		case "auth":
+			if len(p.args) != 1 || p.block != nil {
+				return res, p.errorf("expected authentication method")
+			}
+			switch p.args[0] {
+			case socksAuthNone, socksAuthPassword, socksAuthPAM, socksAuthTLS:
+				res.auth = p.args[0]
+			default:
+				return res, p.errorf("unknown authentication method %q, expected %q, %q, %q or %q",
+					p.args[0], socksAuthNone, socksAuthPassword, socksAuthPAM, socksAuthTLS)
+			}
+		case "password":
+			if len(p.args) != 2 || p.block != nil {
+				return res, p.errorf("expected username and password")
+			}
+			if res.passwords == nil {
+				res.passwords = make(map[string]string)
+			}
+			if _, ok := res.passwords[p.args[0]]; ok {
+				return res, p.errorf("password of %q is already set", p.args[0])
+			}
+			res.passwords[p.args[0]] = p.args[1]
+		case "pam-service":
+			if len(p.args) != 1 || p.block != nil {
+				return res, p.errorf("expected PAM service name")
+			}
+			res.pamService = p.args[0]
+		case "tls-cert", "tls-key", "tls-peers":
+			if len(p.args) != 1 || p.block != nil {
+				return res, p.errorf("expected a single value")
+			}
+			switch p.name {
+			case "tls-cert":
+				res.tlsCert = p.args[0]
+			case "tls-key":
+				res.tlsKey = p.args[0]
+			default:
+				res.tlsPeers = p.args[0]
+			}
+		default:
+			return res, p.errorf("unknown listener parameter")
+		}
+	}
+
+	hasTLS := res.tlsCert != "" || res.tlsKey != "" || res.tlsPeers != ""
+	switch res.auth {
+	case "":
+		if len(d.block) != 0 {
+			return res, d.errorf("%s: expected auth", res.listen)
+		}
+	case socksAuthPassword:
+		if len(res.passwords) == 0 {
+			return res, d.errorf("%s: password authentication needs at least one password", res.listen)
+		}
+	case socksAuthPAM:
+		if res.pamService == "" {
+			return res, d.errorf("%s: PAM authentication needs pam-service", res.listen)
+		}
+	case socksAuthTLS:
+		if res.tlsCert == "" || res.tlsKey == "" || res.tlsPeers == "" {
+			return res, d.errorf("%s: TLS authentication needs tls-cert, tls-key and tls-peers", res.listen)
+		}
+	}
+	if res.auth != socksAuthPassword && len(res.passwords) != 0 {
+		return res, d.errorf("%s: passwords are only used by password authentication", res.listen)
+	}
+	if res.auth != socksAuthPAM && res.pamService != "" {
+		return res, d.errorf("%s: PAM service is only used by PAM authentication", res.listen)
+	}
+	if res.auth != socksAuthTLS && hasTLS {
+		return res, d.errorf("%s: TLS parameters are only used by TLS authentication", res.listen)
+	}
+	return res, nil
+}
+
+// describe formats authentication of the listener
+func (l socksListener) describe() string {
+	switch l.auth {
+	case "":
+		return "global auth"
+	case socksAuthPassword:
+		return fmt.Sprintf("%s (%d users)", l.auth, len(l.passwords))
+	case socksAuthPAM:
+		return fmt.Sprintf("%s (service %s)", l.auth, l.pamService)
+	default:
+		return l.auth
+	}
+}
+
+// socksAddresses returns listen addresses of SOCKS listeners
+func socksAddresses(ls []socksListener) []string {
+	res := make([]string, 0, len(ls))
+	for _, l := range ls {
+		res = append(res, l.listen)
+	}
+	return res
+}
+
+// socksAuth is authentication of a SOCKS listener
+type socksAuth struct {
+	authenticators []socks5.Authenticator
+	// tlsConfig secures accepted connections if set
+	tlsConfig *tls.Config
+	// peerIdentity is set when clients are trusted throttlesocks instances
+	peerIdentity bool
+}
+
+// authenticate creates authentication of a listener that sets its own
+// authentication method. Certificate of TLS authentication is reloaded
+// every reload interval when its files change.
+func (l socksListener) authenticate(reload time.Duration) (socksAuth, error) {
+	switch l.auth {
+	case socksAuthNone:
+		return socksAuth{authenticators: []socks5.Authenticator{socks5.NoAuthAuthenticator{}}}, nil
+	case socksAuthPassword:
+		return socksAuth{authenticators: []socks5.Authenticator{
+			socks5.UserPassAuthenticator{Credentials: passwordCredentials(l.passwords)},
+		}}, nil
+	case socksAuthPAM:
+		credentials, err := newPAMCredentials(l.pamService)
+		if err != nil {
+			return socksAuth{}, err
+		}
+		return socksAuth{authenticators: []socks5.Authenticator{
+			socks5.UserPassAuthenticator{Credentials: credentials},
+		}}, nil
+	case socksAuthTLS:
+		certs, err := newCertReloader(l.tlsCert, l.tlsKey)
+		if err != nil {
+			return socksAuth{}, err
+		}
+		certs.watch(reload)
+		tlsConfig, err := serverTLSConfig(certs, l.tlsPeers)
+		if err != nil {
+			return socksAuth{}, err
+		}
+		return socksAuth{
+			// Peers propagate identity of their clients as credentials
+			authenticators: []socks5.Authenticator{
+				socks5.NoAuthAuthenticator{},
+				socks5.UserPassAuthenticator{Credentials: anyCredentials{}},
+			},
+			tlsConfig:    tlsConfig,
+			peerIdentity: true,
+		}, nil
+	}
+	return socksAuth{}, fmt.Errorf("Listener %s doesn't set authentication method", l.listen)
+}
+
+// passwordCredentials is a socks5.CredentialStore that accepts listed
+// usernames with their passwords
+type passwordCredentials map[string]string
+
+func (c passwordCredentials) Valid(user, password, userAddr string) bool {
+	expected, ok := c[user]
+	// Unknown users take as long to check as known ones
+	match := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+	return ok && match
+}
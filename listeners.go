@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Environment variables used to hand listening sockets over to a new process
+// during upgrade. Listeners variable holds semicolon-separated list of
+// "<network> <address>" keys of inherited sockets. Sockets are passed as
+// file descriptors starting from 3 in the same order.
+const (
+	listenersEnv = "THROTTLESOCKS_LISTENERS"
+	readyFDEnv   = "THROTTLESOCKS_READY_FD"
+)
+
+// firstInheritedFD is the first file descriptor passed with exec.Cmd.ExtraFiles
+const firstInheritedFD = 3
+
+// listenerSet creates all listening sockets of the process and keeps track
+// of them so that they can be handed over to a new process on upgrade
+type listenerSet struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	keys      []string
+	files     []fileListener
+	closing   bool
+}
+
+// fileListener is anything listening that can be duplicated as a file
+// (*net.TCPListener, *net.UnixListener, *net.UDPConn)
+type fileListener interface {
+	File() (*os.File, error)
+	Close() error
+}
+
+// newListenerSet creates listenerSet picking up sockets inherited from the
+// previous process (if any)
+func newListenerSet() *listenerSet {
+	s := &listenerSet{inherited: make(map[string]*os.File)}
+	env := os.Getenv(listenersEnv)
+	os.Unsetenv(listenersEnv)
+	if env == "" {
+		return s
+	}
+	for i, key := range strings.Split(env, ";") {
+		fd := uintptr(firstInheritedFD + i)
+		s.inherited[key] = os.NewFile(fd, key)
+	}
+	return s
+}
+
+func listenerKey(network, addr string) string {
+	return network + " " + addr
+}
+
+// Takes inherited socket for a key if there is one
+func (s *listenerSet) takeInherited(key string) *os.File {
+	f := s.inherited[key]
+	delete(s.inherited, key)
+	return f
+}
+
+// listen is like net.Listen, but reuses inherited socket if there is one
+func (s *listenerSet) listen(network, addr string) (net.Listener, error) {
+	return s.listenKey(listenerKey(network, addr), func() (net.Listener, error) {
+		return net.Listen(network, addr)
+	})
+}
+
+// listenWorkers creates given number of listeners bound to the same address
+// with SO_REUSEPORT. Single worker gets a plain listener.
+func (s *listenerSet) listenWorkers(network, addr string, workers int) ([]net.Listener, error) {
+	if workers <= 1 {
+		l, err := s.listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	ls := make([]net.Listener, 0, workers)
+	for i := 0; i < workers; i++ {
+		key := fmt.Sprintf("%s#%d", listenerKey(network, addr), i)
+		l, err := s.listenKey(key, func() (net.Listener, error) {
+			return listenReusePort(network, addr)
+		})
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// unixScheme is the prefix of listen addresses that are paths of Unix domain
+// sockets
+const unixScheme = "unix://"
+
+// listenUnix listens on a Unix domain socket at path and sets its
+// permissions. Socket file left by a previous process is replaced unless
+// something still accepts connections on it. Socket file is kept once
+// listener is closed, so that it stays usable after upgrade.
+func (s *listenerSet) listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := s.listenKey(listenerKey("unix", path), func() (net.Listener, error) {
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", path); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("Socket %s is in use", path)
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	return l, nil
+}
+
+// Creates a listener with a given key using either an inherited socket or
+// a create function
+func (s *listenerSet) listenKey(key string, create func() (net.Listener, error)) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l net.Listener
+	var err error
+	if f := s.takeInherited(key); f != nil {
+		l, err = net.FileListener(f)
+		f.Close()
+	} else {
+		l, err = create()
+	}
+	if err != nil {
+		return nil, err
+	}
+	fl, ok := l.(fileListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("Unsupported listener for %s", key)
+	}
+	s.keys = append(s.keys, key)
+	s.files = append(s.files, fl)
+	return l, nil
+}
+
+// listenPacket is like net.ListenPacket, but reuses inherited socket if
+// there is one
+func (s *listenerSet) listenPacket(network, addr string) (net.PacketConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := listenerKey(network, addr)
+	var pc net.PacketConn
+	var err error
+	if f := s.takeInherited(key); f != nil {
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		pc, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fl, ok := pc.(fileListener)
+	if !ok {
+		pc.Close()
+		return nil, fmt.Errorf("Unsupported packet listener for %s", key)
+	}
+	s.keys = append(s.keys, key)
+	s.files = append(s.files, fl)
+	return pc, nil
+}
+
+// ready reports to the previous process (if any) that this process has
+// taken over all listeners. Inherited sockets that are no longer configured
+// are closed.
+func (s *listenerSet) ready() {
+	s.mu.Lock()
+	for key, f := range s.inherited {
+		log.Printf("Closing inherited listener %s which is no longer configured", key)
+		f.Close()
+	}
+	s.inherited = nil
+	s.mu.Unlock()
+
+	env := os.Getenv(readyFDEnv)
+	os.Unsetenv(readyFDEnv)
+	if env == "" {
+		return
+	}
+	var fd uintptr
+	if _, err := fmt.Sscan(env, &fd); err != nil {
+		log.Printf("Bad %s: %v", readyFDEnv, err)
+		return
+	}
+	f := os.NewFile(fd, "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// closeAll stops accepting on all listeners
+func (s *listenerSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	for _, l := range s.files {
+		l.Close()
+	}
+}
+
+// fatalUnlessClosing terminates the process with a serving error unless
+// listeners are being closed intentionally, in which case it blocks
+// forever, leaving it up to whoever closed them to terminate the process
+func (s *listenerSet) fatalUnlessClosing(err error) {
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if closing {
+		select {}
+	}
+	log.Fatal(err)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// logCategory is a category of high-volume log lines, like lines about
+// every accepted connection. Lines of a category may be rate limited,
+// sampled or turned off. Lines that are rate limited or sampled out are
+// counted and reported by summaries.
+type logCategory struct {
+	name string
+	// limiter lets through a number of lines per second if set
+	limiter *rate.Limiter
+	// sample is the fraction of lines logged if it's non-zero
+	sample float64
+	// off suppresses all lines
+	off bool
+
+	suppressed uint64
+}
+
+// High-volume log categories. Lines about closed connections are off and
+// lines of other categories are logged unless configureLogCategories says
+// otherwise.
+var (
+	logAccepted = &logCategory{name: "accepted"}
+	logClosed   = &logCategory{name: "closed", off: true}
+	logRejected = &logCategory{name: "rejected"}
+)
+
+var logCategories = []*logCategory{logAccepted, logClosed, logRejected}
+
+// Printf logs a line of the category unless it's suppressed. Lines of
+// categories that are off aren't counted.
+func (c *logCategory) Printf(format string, v ...interface{}) {
+	if c.off {
+		return
+	}
+	if c.allow() {
+		log.Printf(format, v...)
+		return
+	}
+	atomic.AddUint64(&c.suppressed, 1)
+}
+
+func (c *logCategory) allow() bool {
+	switch {
+	case c.limiter != nil:
+		return c.limiter.Allow()
+	case c.sample > 0:
+		return rand.Float64() < c.sample
+	}
+	return true
+}
+
+// configureLogCategories parses comma-separated list of category=setting
+// pairs (for example 'accepted=100/s,closed=1%,rejected=off') and starts
+// logging summaries of suppressed lines every 'summary'. Setting is the
+// number of lines per second ('100/s'), percentage of lines logged ('1%'),
+// 'off' or 'all'. It must be called before anything is logged.
+func configureLogCategories(spec string, summary time.Duration) error {
+	if spec == "" {
+		return nil
+	}
+	if summary <= 0 {
+		return fmt.Errorf("Log summary interval must be positive")
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Failed to parse %q, expected <category>=<setting>", pair)
+		}
+		c := findLogCategory(kv[0])
+		if c == nil {
+			return fmt.Errorf("Unknown log category %q, expected one of %s", kv[0], logCategoryNames())
+		}
+		if err := c.configure(kv[1]); err != nil {
+			return err
+		}
+	}
+	go func() {
+		for range time.Tick(summary) {
+			for _, c := range logCategories {
+				if n := atomic.SwapUint64(&c.suppressed, 0); n > 0 {
+					log.Printf("%d %s log lines suppressed in the last %v", n, c.name, summary)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *logCategory) configure(setting string) error {
+	c.limiter, c.sample, c.off = nil, 0, false
+	switch {
+	case setting == "all":
+	case setting == "off":
+		c.off = true
+	case strings.HasSuffix(setting, "/s"):
+		n, err := strconv.ParseFloat(strings.TrimSuffix(setting, "/s"), 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("Bad rate %q of %s log lines", setting, c.name)
+		}
+		burst := int(n)
+		if burst < 1 {
+			burst = 1
+		}
+		c.limiter = rate.NewLimiter(rate.Limit(n), burst)
+	case strings.HasSuffix(setting, "%"):
+		n, err := strconv.ParseFloat(strings.TrimSuffix(setting, "%"), 64)
+		if err != nil || n <= 0 || n > 100 {
+			return fmt.Errorf("Bad percentage %q of %s log lines", setting, c.name)
+		}
+		c.sample = n / 100
+	default:
+		return fmt.Errorf("Bad setting %q of %s log lines, expected like '100/s', '1%%', 'off' or 'all'", setting, c.name)
+	}
+	return nil
+}
+
+func findLogCategory(name string) *logCategory {
+	for _, c := range logCategories {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func logCategoryNames() string {
+	names := make([]string, 0, len(logCategories))
+	for _, c := range logCategories {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maintenance keeps track of listeners put into maintenance through admin
+// API. Listeners in maintenance close new connections right away or, if
+// they serve SOCKS, may reject their requests with "connection not allowed"
+// reply instead. Existing connections are left to finish.
+type maintenance struct {
+	mu sync.Mutex
+	// listeners tells whether a known listen address serves SOCKS
+	listeners map[string]bool
+	states    map[string]maintenanceState
+}
+
+// maintenanceState describes a listener in maintenance
+type maintenanceState struct {
+	// reject is set if SOCKS requests are rejected rather than connections
+	// closed
+	reject bool
+	since  time.Time
+}
+
+func newMaintenance() *maintenance {
+	return &maintenance{
+		listeners: make(map[string]bool),
+		states:    make(map[string]maintenanceState),
+	}
+}
+
+// register makes a listen address known so that it may be put into
+// maintenance
+func (m *maintenance) register(addr string, socks bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners[addr] = socks
+}
+
+// enter puts a listener into maintenance. 'by' describes who asked for it.
+func (m *maintenance) enter(addr string, reject bool, by string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	socks, ok := m.listeners[addr]
+	if !ok {
+		return fmt.Errorf("Unknown listener %s", addr)
+	}
+	if reject && !socks {
+		return fmt.Errorf("Listener %s doesn't serve SOCKS, so its connections can only be closed", addr)
+	}
+	m.states[addr] = maintenanceState{reject: reject, since: time.Now()}
+	action := "closed"
+	if reject {
+		action = "rejected"
+	}
+	log.Printf("Listener %s is in maintenance, new connections are %s (by %s)", addr, action, by)
+	return nil
+}
+
+// leave brings a listener back from maintenance
+func (m *maintenance) leave(addr string, by string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.states[addr]; !ok {
+		return fmt.Errorf("Listener %s is not in maintenance", addr)
+	}
+	delete(m.states, addr)
+	log.Printf("Listener %s is back from maintenance (by %s)", addr, by)
+	return nil
+}
+
+// state returns maintenance state of a listener and whether it's in
+// maintenance at all
+func (m *maintenance) state(addr string) (maintenanceState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.states[addr]
+	return s, ok
+}
+
+// list returns addresses of listeners in maintenance in order
+func (m *maintenance) list() []string {
+	m.mu.Lock()
+	res := make([]string, 0, len(m.states))
+	for addr := range m.states {
+		res = append(res, addr)
+	}
+	m.mu.Unlock()
+	sort.Strings(res)
+	return res
+}
+
+// maintenanceListener closes accepted connections while its address is in
+// maintenance unless SOCKS requests are to be rejected instead
+type maintenanceListener struct {
+	net.Listener
+	maintenance *maintenance
+	addr        string
+}
+
+func (l maintenanceListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := l.maintenance.state(l.addr); ok && !s.reject {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
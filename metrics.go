@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+)
+
+// delayBuckets are upper bounds of limiter delay histogram buckets in
+// seconds
+var delayBuckets = []float64{0, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// delayKey identifies a limiter delay histogram. Limiter is what limits
+// connections: 'global', 'forward', 'user:<tag>', 'class:<name>',
+// 'rule:<position>', 'sniff:<class>' or 'connection' for connections
+// limited by themselves.
+type delayKey struct {
+	direction string
+	limiter   string
+}
+
+// delayHistogram counts reads and writes by time they were delayed for
+type delayHistogram struct {
+	// counts has a counter per bucket plus one for delays exceeding the
+	// last bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// delayMetrics keeps histograms of delays added by limiters to reads from
+// and writes to destinations
+type delayMetrics struct {
+	mu    sync.Mutex
+	hists map[delayKey]*delayHistogram
+}
+
+func newDelayMetrics() *delayMetrics {
+	return &delayMetrics{hists: make(map[delayKey]*delayHistogram)}
+}
+
+func (m *delayMetrics) observe(key delayKey, d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(delayBuckets, seconds)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.hists[key]
+	if !ok {
+		h = &delayHistogram{counts: make([]uint64, len(delayBuckets)+1)}
+		m.hists[key] = h
+	}
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// connTracer returns a tracer recording delays of a connection limited by
+// given limiter
+func (m *delayMetrics) connTracer(limiter string) func(throttle.Trace) {
+	read := delayKey{direction: "read", limiter: limiter}
+	write := delayKey{direction: "write", limiter: limiter}
+	return func(t throttle.Trace) {
+		if t.Write {
+			m.observe(write, t.Delay)
+		} else {
+			m.observe(read, t.Delay)
+		}
+	}
+}
+
+// writePrometheus writes histograms in Prometheus text format
+func (m *delayMetrics) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	keys := make([]delayKey, 0, len(m.hists))
+	hists := make(map[delayKey]delayHistogram, len(m.hists))
+	for key, h := range m.hists {
+		keys = append(keys, key)
+		hists[key] = delayHistogram{counts: append([]uint64(nil), h.counts...), sum: h.sum, count: h.count}
+	}
+	m.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].limiter != keys[j].limiter {
+			return keys[i].limiter < keys[j].limiter
+		}
+		return keys[i].direction < keys[j].direction
+	})
+
+	const name = "throttlesocks_limiter_delay_seconds"
+	fmt.Fprintf(w, "# HELP %s Time reads from and writes to destinations were delayed by limiters.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for _, key := range keys {
+		h := hists[key]
+		labels := fmt.Sprintf("direction=%q,limiter=%q", key.direction, key.limiter)
+		var cumulative uint64
+		for i, bound := range delayBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels,
+				strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorQueueSize is the number of chunks that may wait for a slow sink
+// before further chunks get dropped
+const mirrorQueueSize = 256
+
+// sink describes where mirrored traffic goes
+type sink struct {
+	// network is "tcp" or "file"
+	network string
+	// address is either TCP address or a directory
+	address string
+}
+
+// parseSink parses sink specification. Sink is either 'tcp://host:port',
+// in which case a TCP connection is opened per mirrored direction, or
+// 'file:///some/dir', in which case a file is created in that directory per
+// mirrored direction.
+func parseSink(s string) (sink, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return sink{}, fmt.Errorf("Failed to parse sink %q: %w", s, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return sink{}, fmt.Errorf("Sink %q has no address", s)
+		}
+		return sink{network: "tcp", address: u.Host}, nil
+	case "file":
+		if u.Path == "" {
+			return sink{}, fmt.Errorf("Sink %q has no directory", s)
+		}
+		return sink{network: "file", address: u.Path}, nil
+	}
+	return sink{}, fmt.Errorf("Unsupported sink %q, expected tcp://host:port or file:///dir", s)
+}
+
+// open opens a sink stream for one direction of a connection
+func (s sink) open(dest string, direction string) (io.WriteCloser, error) {
+	if s.network == "tcp" {
+		return net.Dial("tcp", s.address)
+	}
+	name := fmt.Sprintf("%s-%s-%s.bin", time.Now().Format("20060102T150405.000000000"),
+		strings.NewReplacer(":", "_", "/", "_").Replace(dest), direction)
+	return os.Create(filepath.Join(s.address, name))
+}
+
+// mirrorStream asynchronously writes chunks into a sink, dropping them if
+// the sink can't keep up so that it never slows down the relay
+type mirrorStream struct {
+	mu      sync.Mutex
+	chunks  chan []byte
+	closed  bool
+	dropped int
+}
+
+func newMirrorStream(w io.WriteCloser) *mirrorStream {
+	s := &mirrorStream{chunks: make(chan []byte, mirrorQueueSize)}
+	go func() {
+		defer w.Close()
+		failed := false
+		for chunk := range s.chunks {
+			if failed {
+				continue
+			}
+			if _, err := w.Write(chunk); err != nil {
+				log.Printf("Failed to write to mirror: %v", err)
+				failed = true
+			}
+		}
+	}()
+	return s
+}
+
+func (s *mirrorStream) write(b []byte) {
+	chunk := make([]byte, len(b))
+	copy(chunk, b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.chunks <- chunk:
+	default:
+		s.dropped++
+	}
+}
+
+// close stops the stream and returns the number of dropped chunks
+func (s *mirrorStream) close() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.chunks)
+	}
+	return s.dropped
+}
+
+// mirrorConn is a net.Conn that copies everything read from and written to
+// inner connection into separate mirror streams
+type mirrorConn struct {
+	net.Conn
+	read    *mirrorStream
+	written *mirrorStream
+}
+
+// newMirrorConn wraps connection so that its traffic is copied to a sink
+func newMirrorConn(inner net.Conn, s sink) (*mirrorConn, error) {
+	dest := inner.RemoteAddr().String()
+	r, err := s.open(dest, "read")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open mirror: %w", err)
+	}
+	w, err := s.open(dest, "written")
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("Failed to open mirror: %w", err)
+	}
+	return &mirrorConn{
+		Conn:    inner,
+		read:    newMirrorStream(r),
+		written: newMirrorStream(w),
+	}, nil
+}
+
+func (c *mirrorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.read.write(b[:n])
+	}
+	return n, err
+}
+
+func (c *mirrorConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.written.write(b[:n])
+	}
+	return n, err
+}
+
+func (c *mirrorConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *mirrorConn) Close() error {
+	err := c.Conn.Close()
+	if dropped := c.read.close() + c.written.close(); dropped > 0 {
+		log.Printf("Mirror of connection to %v dropped %d chunks", c.RemoteAddr(), dropped)
+	}
+	return err
+}
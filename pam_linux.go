@@ -0,0 +1,133 @@
+//go:build linux && pam
+// +build linux,pam
+
+package main
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+// Answers prompts of PAM modules with the password passed as appdata
+static int throttlesocks_pam_conv(int n, const struct pam_message **msg,
+		struct pam_response **resp, void *appdata) {
+	struct pam_response *r = calloc(n, sizeof(struct pam_response));
+	if (r == NULL) {
+		return PAM_BUF_ERR;
+	}
+	for (int i = 0; i < n; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+		case PAM_PROMPT_ECHO_ON:
+			r[i].resp = strdup((const char *)appdata);
+			if (r[i].resp == NULL) {
+				goto fail;
+			}
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			break;
+		default:
+			goto fail;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+
+fail:
+	for (int i = 0; i < n; i++) {
+		free(r[i].resp);
+	}
+	free(r);
+	return PAM_CONV_ERR;
+}
+
+// Authenticates user and checks that their account may be used
+static int throttlesocks_pam_authenticate(const char *service, const char *user,
+		const char *password, const char *rhost) {
+	struct pam_conv conv = { throttlesocks_pam_conv, (void *)password };
+	pam_handle_t *h = NULL;
+	int res = pam_start(service, user, &conv, &h);
+	if (res != PAM_SUCCESS) {
+		return res;
+	}
+	if (rhost[0] != 0) {
+		res = pam_set_item(h, PAM_RHOST, rhost);
+	}
+	if (res == PAM_SUCCESS) {
+		res = pam_authenticate(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	if (res == PAM_SUCCESS) {
+		res = pam_acct_mgmt(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	pam_end(h, res);
+	return res;
+}
+*/
+import "C"
+
+import (
+	"net"
+	"strings"
+	"unsafe"
+
+	"github.com/thinkgos/go-socks5"
+)
+
+// maxPAMConversations bounds the number of PAM conversations going on at
+// once. PAM modules may take seconds to answer (for example, pam_unix delays
+// failures), so that clients hammering the listener with bad credentials
+// would otherwise pile up threads blocked in PAM.
+const maxPAMConversations = 32
+
+// pamConversations holds a token for every PAM conversation going on. It's
+// shared by all PAM services.
+var pamConversations = make(chan struct{}, maxPAMConversations)
+
+// pamCredentials is a socks5.CredentialStore that validates credentials
+// through a PAM service, so that system accounts and whatever PAM modules
+// are set up for the service gate access
+type pamCredentials struct {
+	service string
+}
+
+func newPAMCredentials(service string) (socks5.CredentialStore, error) {
+	return pamCredentials{service: service}, nil
+}
+
+func (c pamCredentials) Valid(user, password, userAddr string) bool {
+	if strings.ContainsRune(user, 0) || strings.ContainsRune(password, 0) {
+		logRejected.Printf("Rejecting authentication of %s (user %q): credentials contain NUL", userAddr, user)
+		return false
+	}
+	select {
+	case pamConversations <- struct{}{}:
+		defer func() { <-pamConversations }()
+	default:
+		logRejected.Printf("Rejecting authentication of %s (user %q): %d PAM conversations are already going on",
+			userAddr, user, maxPAMConversations)
+		return false
+	}
+	rhost, _, err := net.SplitHostPort(userAddr)
+	if err != nil {
+		rhost = ""
+	}
+	cService := C.CString(c.service)
+	defer C.free(unsafe.Pointer(cService))
+	cUser := C.CString(user)
+	defer C.free(unsafe.Pointer(cUser))
+	cPassword := C.CString(password)
+	defer C.free(unsafe.Pointer(cPassword))
+	cRHost := C.CString(rhost)
+	defer C.free(unsafe.Pointer(cRHost))
+
+	res := C.throttlesocks_pam_authenticate(cService, cUser, cPassword, cRHost)
+	if res != C.PAM_SUCCESS {
+		// Linux-PAM doesn't need a handle to describe errors
+		logRejected.Printf("Rejecting authentication of %s (user %q): PAM service %s: %s", userAddr, user,
+			c.service, C.GoString(C.pam_strerror(nil, res)))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,14 @@
+//go:build !linux || !pam
+// +build !linux !pam
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/thinkgos/go-socks5"
+)
+
+func newPAMCredentials(service string) (socks5.CredentialStore, error) {
+	return nil, fmt.Errorf("PAM authentication is only supported on Linux by builds with 'pam' build tag")
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pcap file format constants. Packets are raw IP packets without link layer
+// header (LINKTYPE_RAW).
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapSnapLen  = 65535
+	pcapLinkType = 101
+)
+
+// pcapMaxSegment is the largest payload of a single synthesized TCP segment.
+// It keeps IP packets within 65535 bytes.
+const pcapMaxSegment = 65000
+
+// TCP flags of synthesized segments
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpACK = 0x10
+	tcpPSH = 0x08
+)
+
+// pcapFile is a capture file shared by all connections captured into it
+type pcapFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+	err  error
+}
+
+// openPcapFiles creates capture files for all given paths. Empty paths are
+// skipped.
+func openPcapFiles(paths []string) (map[string]*pcapFile, error) {
+	res := make(map[string]*pcapFile)
+	for _, path := range paths {
+		if path == "" || res[path] != nil {
+			continue
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		hdr := make([]byte, 24)
+		binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+		binary.LittleEndian.PutUint16(hdr[4:], 2)
+		binary.LittleEndian.PutUint16(hdr[6:], 4)
+		binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+		binary.LittleEndian.PutUint32(hdr[20:], pcapLinkType)
+		if _, err := f.Write(hdr); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Failed to write pcap header to %s: %w", path, err)
+		}
+		res[path] = &pcapFile{f: f, path: path}
+	}
+	return res, nil
+}
+
+// writePacket appends a packet record. Once writing fails, the error is
+// reported and the file is no longer written to.
+func (p *pcapFile) writePacket(t time.Time, packet []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return
+	}
+	rec := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(packet)))
+	if _, p.err = p.f.Write(append(rec, packet...)); p.err != nil {
+		log.Printf("Failed to write to pcap file %s: %v", p.path, p.err)
+	}
+}
+
+// pcapEndpoint is one side of a synthesized TCP flow
+type pcapEndpoint struct {
+	ip   net.IP
+	port uint16
+	// seq is the next sequence number of the side
+	seq uint32
+	fin bool
+}
+
+// pcapFlow synthesizes TCP packets of a relayed connection between a client
+// and a destination
+type pcapFlow struct {
+	mu     sync.Mutex
+	file   *pcapFile
+	client pcapEndpoint
+	server pcapEndpoint
+}
+
+// newPcapFlow starts a flow with a three-way handshake
+func newPcapFlow(file *pcapFile, client, server string) *pcapFlow {
+	c, s := pcapAddr(client, 1), pcapAddr(server, 2)
+	if (c.ip.To4() == nil) != (s.ip.To4() == nil) {
+		// Can't mix families in a single packet, so use IPv4-mapped
+		// addresses
+		c.ip, s.ip = c.ip.To16(), s.ip.To16()
+	} else if c.ip.To4() != nil {
+		c.ip, s.ip = c.ip.To4(), s.ip.To4()
+	}
+	fl := &pcapFlow{file: file, client: c, server: s}
+	fl.client.seq, fl.server.seq = 1000, 2000
+	now := time.Now()
+	fl.segment(now, &fl.client, &fl.server, tcpSYN, nil)
+	fl.segment(now, &fl.server, &fl.client, tcpSYN|tcpACK, nil)
+	fl.segment(now, &fl.client, &fl.server, tcpACK, nil)
+	return fl
+}
+
+// pcapAddr converts "ip:port" address into flow endpoint. Anything else
+// gets a loopback address with a placeholder port.
+func pcapAddr(addr string, placeholderPort uint16) pcapEndpoint {
+	host, portString, err := net.SplitHostPort(addr)
+	if err == nil {
+		ip := net.ParseIP(host)
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if ip != nil && err == nil {
+			return pcapEndpoint{ip: ip, port: uint16(port)}
+		}
+	}
+	return pcapEndpoint{ip: net.IPv4(127, 0, 0, 1), port: placeholderPort}
+}
+
+// data records bytes sent by client (if fromClient) or server
+func (fl *pcapFlow) data(fromClient bool, b []byte) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	src, dst := &fl.server, &fl.client
+	if fromClient {
+		src, dst = dst, src
+	}
+	now := time.Now()
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		fl.segment(now, src, dst, tcpACK|tcpPSH, b[:n])
+		b = b[n:]
+	}
+}
+
+// fin records one side closing its sending direction
+func (fl *pcapFlow) fin(fromClient bool) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	src, dst := &fl.server, &fl.client
+	if fromClient {
+		src, dst = dst, src
+	}
+	if src.fin {
+		return
+	}
+	src.fin = true
+	fl.segment(time.Now(), src, dst, tcpFIN|tcpACK, nil)
+}
+
+// segment writes a single TCP segment from src to dst advancing sequence
+// number of src
+func (fl *pcapFlow) segment(t time.Time, src, dst *pcapEndpoint, flags byte, payload []byte) {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	src.seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		src.seq++
+	}
+
+	var packet []byte
+	var pseudo []byte
+	if v4 := src.ip.To4(); v4 != nil && len(src.ip) == net.IPv4len {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(packet[6:], 0x4000)
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:], v4)
+		copy(packet[16:], dst.ip.To4())
+		binary.BigEndian.PutUint16(packet[10:], ^checksum(0, packet))
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], packet[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:], src.ip.To16())
+		copy(packet[24:], dst.ip.To16())
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], packet[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+	}
+	binary.BigEndian.PutUint16(tcp[16:], ^checksum(checksum(0, pseudo), tcp))
+	fl.file.writePacket(t, append(packet, tcp...))
+}
+
+// checksum adds data to a ones' complement sum used by IP and TCP checksums
+func checksum(sum uint16, data []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
+
+// pcapConn is a net.Conn wrapping connection to destination that records
+// everything relayed through it into a capture file as a TCP flow between
+// the client and the destination
+type pcapConn struct {
+	net.Conn
+	flow      *pcapFlow
+	closeOnce sync.Once
+}
+
+// newPcapConn wraps connection to destination so that its traffic is
+// captured. Client is the address of the SOCKS client or forward peer.
+func newPcapConn(inner net.Conn, file *pcapFile, client string) *pcapConn {
+	// Clients of peers look like "<client> via <peer>"
+	if _, _, err := net.SplitHostPort(client); err != nil {
+		client = inner.LocalAddr().String()
+	}
+	return &pcapConn{Conn: inner, flow: newPcapFlow(file, client, inner.RemoteAddr().String())}
+}
+
+func (c *pcapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.flow.data(false, b[:n])
+	}
+	if err == io.EOF {
+		c.flow.fin(false)
+	}
+	return n, err
+}
+
+func (c *pcapConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.flow.data(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *pcapConn) CloseWrite() error {
+	err := closeWrite(c.Conn)
+	if err == nil {
+		c.flow.fin(true)
+	}
+	return err
+}
+
+func (c *pcapConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.flow.fin(true)
+		c.flow.fin(false)
+	})
+	return c.Conn.Close()
+}
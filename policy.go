@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// policyTimeout limits how long a policy decision may take
+const policyTimeout = 2 * time.Second
+
+// policy is an external policy engine consulted for every SOCKS connection
+// through HTTP. It speaks Open Policy Agent data API: input is posted as
+// {"input": {...}} and the decision is expected in the "result" field.
+type policy struct {
+	url    string
+	client *http.Client
+}
+
+// policyInput describes connection request to policy engine
+type policyInput struct {
+	Client string `json:"client"`
+	User   string `json:"user"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+}
+
+// policyDecision is a decision of policy engine. Class is the name of a
+// rate class the connection is assigned to (may be empty).
+type policyDecision struct {
+	Allow bool   `json:"allow"`
+	Class string `json:"class"`
+}
+
+func newPolicy(url string) *policy {
+	return &policy{url: url, client: &http.Client{Timeout: policyTimeout}}
+}
+
+// decide asks policy engine about a connection
+func (p *policy) decide(meta connMeta) (policyDecision, error) {
+	var decision policyDecision
+	body, err := json.Marshal(map[string]policyInput{
+		"input": {Client: meta.client, User: meta.tag, Host: meta.host, Port: meta.port},
+	})
+	if err != nil {
+		return decision, err
+	}
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return decision, fmt.Errorf("Policy request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("Policy request failed with status %s", resp.Status)
+	}
+	var res struct {
+		Result *policyDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return decision, fmt.Errorf("Failed to decode policy decision: %w", err)
+	}
+	// OPA omits result when policy is undefined for the input
+	if res.Result == nil {
+		return decision, fmt.Errorf("Policy returned no decision")
+	}
+	return *res.Result, nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// proxy holds state shared by everything that relays connections: limiters,
+// rules and accounting
+type proxy struct {
+	// limiter is used by connections that have no more specific limiter
+	limiter throttle.Limiter
+	// sniffLimiters are per-class limiters for sniffed connections. Sniffing
+	// is disabled if nil.
+	sniffLimiters map[string]throttle.Limiter
+	// userLimiters are limiters of rate classes assigned to users
+	userLimiters map[string]throttle.Limiter
+	rules        ruleList
+	registry     *connRegistry
+	maxLifetime  time.Duration
+	// link is emulated network conditions between the proxy and destinations
+	link link
+	// maxSegment limits size of every read and write of connections unless
+	// rules say otherwise. Unlimited if zero.
+	maxSegment int
+	// ramp is the time it takes new connections to get from rampStart to
+	// the rate of whichever limiter applies. Disabled if zero.
+	ramp      time.Duration
+	rampStart rate.Limit
+	// floor is the rate every connection under a shared limiter is
+	// guaranteed. Disabled if zero.
+	floor rate.Limit
+	// randomRate draws rates of connections limited by themselves in place
+	// of limiters of the global limit, users, classes and rules. Disabled if
+	// nil.
+	randomRate *rateDistribution
+	// coalesce is the delay small writes are batched within. Disabled if
+	// zero.
+	coalesce time.Duration
+	// batch is the number of bytes connections reserve from their limiters
+	// at once in high-rate mode. Every read and write reserves bytes it
+	// transfers if zero.
+	batch int
+	// budget provides buffers connections copy data through if set
+	budget *throttle.BufferBudget
+	// readAhead is the size of buffers connections read from destinations
+	// ahead of their limiters into. Disabled if zero.
+	readAhead int
+	// monitor is set if connections are only accounted, but never delayed by
+	// limiters
+	monitor bool
+	// adaptive configures throttling of connections to congested
+	// destinations. Disabled if nil.
+	adaptive *adaptiveSettings
+	// shaper marks sockets of destinations so that kernel enforces global
+	// limit and link conditions on them. Shaping is done in userspace if nil.
+	shaper *kernelShaper
+	// tracer receives limiter reservations of connections if set
+	tracer *limiterTracer
+	// metrics records delays added by limiters if set
+	metrics *delayMetrics
+	// listenAddress is the configured SOCKS listen address connections are
+	// accounted under
+	listenAddress string
+	// maintenance holds listeners put into maintenance
+	maintenance *maintenance
+	// services are listeners of built-in services keyed by their host names
+	services map[string]*builtinListener
+	// peerIdentity is set when clients are trusted throttlesocks instances
+	// propagating addresses of their clients as SOCKS passwords
+	peerIdentity bool
+	// maxRateHint bounds rates clients may request for their connections in
+	// usernames. Rate hints are disabled if zero.
+	maxRateHint rate.Limit
+	// policy is consulted for every SOCKS connection if set
+	policy *policy
+	// deciders are consulted for every SOCKS connection in order
+	deciders []decider
+	// pcap is the path of a capture file all connections are recorded into
+	// unless rules say otherwise. Capturing is disabled if empty.
+	pcap string
+	// pcapFiles are open capture files keyed by their paths
+	pcapFiles map[string]*pcapFile
+	// classes are limiters of rate classes assigned by policy or deciders
+	classes classSet
+	// upstream is a proxy that all connections are dialed through. If nil,
+	// destinations are dialed directly.
+	upstream *upstreamSet
+	// dialFaults fail a fraction of dials if set
+	dialFaults *dialFaults
+	// asns looks up autonomous systems of destinations if set. They are
+	// matched by rules and accounted.
+	asns *asnDB
+}
+
+// connDecision is the outcome of consulting a decider about a connection.
+// Rate is the limit of the connection alone and class is the name of a rate
+// class connection is assigned to. Both may be empty.
+type connDecision struct {
+	allow bool
+	rate  rate.Limit
+	class string
+}
+
+// decider is consulted for every SOCKS connection and may reject it or
+// choose how it's limited (scripts and hooks)
+type decider interface {
+	decide(meta connMeta) (connDecision, error)
+	String() string
+}
+
+// socksDial is a dial function for socks5.Server. It expects SOCKS request
+// to be available in context (see requestRules).
+func (p *proxy) socksDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	req := requestFromContext(ctx)
+	meta := requestMeta(req)
+	meta.listener = p.listenAddress
+	if p.maxRateHint != 0 {
+		var err error
+		meta.tag, meta.rateHint, err = parseRateHint(meta.tag)
+		if err != nil {
+			logRejected.Printf("Rejecting connection from %s: %v", meta.client, err)
+			return nil, err
+		}
+		if meta.rateHint > p.maxRateHint {
+			meta.rateHint = p.maxRateHint
+		}
+	}
+	if p.peerIdentity && req != nil && req.AuthContext != nil {
+		if client := req.AuthContext.Payload["password"]; client != "" {
+			meta.client = client + " via " + meta.client
+		}
+	}
+	if p.policy != nil {
+		decision, err := p.policy.decide(meta)
+		if err == nil && !decision.Allow {
+			err = fmt.Errorf("Denied by policy")
+		}
+		if err == nil && decision.Class != "" {
+			_, err = p.classes.get(decision.Class)
+		}
+		if err != nil {
+			logRejected.Printf("Rejecting connection from %s (tag %q) to %s:%d: %v", meta.client, meta.tag,
+				meta.host, meta.port, err)
+			return nil, err
+		}
+		meta.class = decision.Class
+	}
+	for _, d := range p.deciders {
+		decision, err := d.decide(meta)
+		if err == nil && !decision.allow {
+			err = fmt.Errorf("Denied by %s", d)
+		}
+		if err == nil && decision.class != "" {
+			_, err = p.classes.get(decision.class)
+		}
+		if err != nil {
+			logRejected.Printf("Rejecting connection from %s (tag %q) to %s:%d: %v", meta.client, meta.tag,
+				meta.host, meta.port, err)
+			return nil, err
+		}
+		if decision.class != "" {
+			meta.class = decision.class
+		}
+		if decision.rate != 0 {
+			meta.rate = decision.rate
+		}
+	}
+	logAccepted.Printf("Connection from %s (tag %q) to %s:%d, %s", meta.client, meta.tag,
+		meta.host, meta.port, describeResolution(req))
+	return p.dial(network, addr, meta, nil)
+}
+
+// dial connects to the destination and wraps resulting connection so that
+// it's limited and accounted. If 'limiter' is nil, global one is used.
+// Limiters of user's class, class assigned by policy or deciders, matching
+// rules and sniffed classes take precedence over 'limiter' (each next one
+// over the previous). Rate chosen by deciders takes precedence over all of
+// them and rate hinted by client caps whichever applies. Connections under
+// shared limiters are guaranteed floor rate if it's set. Random rate, if
+// enabled, is drawn for connections having neither. New connections ramp up to
+// whichever limit applies if ramp is enabled and get throttled while path
+// to destination is congested if adaptive throttling is enabled. Global
+// limit is left to kernel if it shapes the connection.
+func (p *proxy) dial(network, addr string, meta connMeta, limiter throttle.Limiter) (*throttle.LimitedConnection, error) {
+	meta.closeReason = &closeReason{}
+	if p.dialFaults != nil {
+		if err := p.dialFaults.inject(addr, meta); err != nil {
+			return nil, err
+		}
+	}
+
+	var netConn net.Conn
+	var err error
+	// direct is set if connection is made to the destination itself
+	direct := false
+	host, _, _ := net.SplitHostPort(addr)
+	if service, ok := p.services[host]; ok {
+		netConn, err = service.dial()
+	} else if p.upstream != nil {
+		netConn, err = p.upstream.dial(network, addr, meta)
+	} else {
+		direct = true
+		netConn, err = net.Dial(network, addr)
+		if err != nil {
+			err = fmt.Errorf("net.Dial: %w", err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.asns != nil {
+		meta.asn, meta.asOrg = p.asns.lookup(destinationIP(meta.host, netConn, direct))
+	}
+	// Rules are matched once autonomous system of the destination is known
+	r := p.rules.match(meta.host, meta.port, meta.tag, meta.asn)
+	if r != nil {
+		r.hit()
+		meta.rule = p.rules.position(r)
+	}
+	// socket is probed for RTT by adaptive throttling
+	socket, _ := netConn.(syscall.Conn)
+	if p.adaptive != nil && socket != nil {
+		meta.adaptive = newAdaptiveController(*p.adaptive, meta.client, netConn.RemoteAddr().String())
+	}
+	// shaped is set if kernel emulates link and enforces global limit
+	shaped := p.shaper != nil && socket != nil && p.shaper.markConn(netConn)
+	if r != nil && (r.resetAfter > 0 || r.resetBytes > 0) {
+		netConn = newResetConn(netConn, meta, r.resetAfter, r.resetBytes)
+	}
+	if p.coalesce > 0 {
+		netConn = newCoalesceConn(netConn, p.coalesce)
+	}
+	if p.link.streams() && !shaped {
+		netConn = newLinkConn(netConn, p.link)
+	}
+	if r != nil && r.mirror != nil {
+		mirrored, err := newMirrorConn(netConn, *r.mirror)
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = mirrored
+	}
+	if r != nil && r.record != "" {
+		recorded, err := newRecordConn(netConn, r.record, meta)
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = recorded
+	}
+	pcap := p.pcap
+	if r != nil && r.pcap != "" {
+		pcap = r.pcap
+	}
+	if pcap != "" {
+		netConn = newPcapConn(netConn, p.pcapFiles[pcap], meta.client)
+	}
+	if p.readAhead > 0 {
+		netConn = newReadAheadConn(netConn, p.readAhead, p.budget)
+	}
+	// limitedBy names the limiter for metrics
+	limitedBy := "forward"
+	if limiter == nil {
+		limiter = p.limiter
+		limitedBy = "global"
+	}
+	if l, ok := p.userLimiters[meta.tag]; ok {
+		limiter = l
+		limitedBy = "user:" + meta.tag
+	}
+	if meta.class != "" {
+		limiter = p.classes[meta.class]
+		limitedBy = "class:" + meta.class
+	}
+	if r != nil && r.limiter != nil {
+		limiter = r.limiter
+		limitedBy = "rule:" + strconv.Itoa(p.rules.position(r))
+		if r.class != "" {
+			limitedBy = "class:" + r.class
+		}
+	}
+	// Kernel enforces global limit of shaped connections, so only their
+	// own limiters are left in userspace. Placeholder stands in for the
+	// global limiter until connection gets a limiter of its own.
+	kernel := shaped && limitedBy == "global"
+	var placeholder throttle.Limiter
+	if kernel {
+		placeholder = throttle.NewLimiter(rate.Inf)
+		limiter = placeholder
+		limitedBy = "kernel"
+	} else {
+		limiter = p.floored(limiter)
+	}
+	if p.randomRate != nil && meta.rate == 0 && meta.rateHint == 0 {
+		meta.rate = p.randomRate.draw()
+		log.Printf("Connection from %s to %s:%d gets random rate %s", meta.client,
+			meta.host, meta.port, formatRate(meta.rate))
+	}
+	if meta.rate != 0 {
+		limiter = throttle.NewLimiter(meta.rate)
+		limitedBy = "connection"
+	}
+	if meta.rateHint != 0 {
+		// Hint only ever slows connection down, it's still charged to
+		// whichever limiter applies
+		limiter = throttle.NewCapLimiter(meta.rateHint, limiter)
+		limitedBy = "connection"
+	}
+	// effective is the rate connection gets at most, which is no more than
+	// the global limit if kernel enforces it
+	effective := throttle.LimitOf(limiter)
+	if global := throttle.LimitOf(p.limiter); kernel && global < effective {
+		effective = global
+	}
+	if p.monitor {
+		limitedBy = "monitor"
+	}
+	meta.throttling = &connThrottling{limitedBy: limitedBy, rate: effective}
+	created := time.Now()
+	var conn *throttle.LimitedConnection
+	var id uint64
+	if p.sniffLimiters != nil {
+		netConn = newSniffConn(netConn, func(class string) {
+			if l, ok := p.sniffLimiters[class]; ok && meta.rate == 0 {
+				l = p.floored(l)
+				if meta.rateHint != 0 {
+					l = throttle.NewCapLimiter(meta.rateHint, l)
+				}
+				conn.SetLimiter(p.connLimiter(l, throttle.LimitOf(l), created, meta.adaptive))
+				conn.SetMonitorOnly(p.monitor)
+				if !p.monitor {
+					conn.SetTracer(p.connTracer(id, meta, "sniff:"+class))
+					meta.throttling.set("sniff:"+class, throttle.LimitOf(l))
+				}
+			}
+		})
+	}
+	chain := p.connLimiter(limiter, effective, created, meta.adaptive)
+	conn = throttle.NewLimitedConnection(netConn, chain)
+	// Connection that is left to kernel alone is only accounted
+	conn.SetMonitorOnly(p.monitor || (placeholder != nil && chain == placeholder))
+	conn.SetBufferBudget(p.budget)
+	if r != nil && r.segment > 0 {
+		conn.SetMaxSegment(r.segment)
+	} else if p.maxSegment > 0 {
+		conn.SetMaxSegment(p.maxSegment)
+	}
+	id = p.registry.add(conn, meta)
+	conn.SetTracer(p.connTracer(id, meta, limitedBy))
+	if p.maxLifetime > 0 {
+		go expireAfter(conn, p.maxLifetime, meta.closeReason)
+	}
+	if meta.adaptive != nil {
+		go meta.adaptive.run(conn, socket)
+	}
+	return conn, nil
+}
+
+// connTracer returns function receiving limiter reservations of a
+// connection limited by a given limiter or nil if neither tracing nor
+// metrics are enabled
+func (p *proxy) connTracer(id uint64, meta connMeta, limitedBy string) func(throttle.Trace) {
+	var tracers []func(throttle.Trace)
+	if p.tracer != nil {
+		tracers = append(tracers, p.tracer.connTracer(id, meta))
+	}
+	if p.metrics != nil {
+		tracers = append(tracers, p.metrics.connTracer(limitedBy))
+	}
+	switch len(tracers) {
+	case 0:
+		return nil
+	case 1:
+		return tracers[0]
+	}
+	return func(t throttle.Trace) {
+		for _, tracer := range tracers {
+			tracer(t)
+		}
+	}
+}
+
+// highRateBatch is the number of bytes connections reserve at once in
+// high-rate mode. It's a fraction of a millisecond at multi-gigabit rates.
+const highRateBatch = 256 * 1024
+
+// newSharedLimiter creates limiter shared by many connections, such as the
+// global one, tuned for multi-gigabit limits in high-rate mode
+func newSharedLimiter(limit rate.Limit, highRate bool) throttle.Limiter {
+	if highRate {
+		return throttle.NewHighRateLimiter(limit)
+	}
+	return throttle.NewLimiter(limit)
+}
+
+// floored returns limiter guaranteeing floor rate to a connection under a
+// given shared limiter if floor is set
+func (p *proxy) floored(shared throttle.Limiter) throttle.Limiter {
+	if p.floor == 0 {
+		return shared
+	}
+	return throttle.NewFloorLimiter(p.floor, p.batch, shared)
+}
+
+// connLimiter returns limiter of a connection created at a given time on
+// top of a given one. It reserves bytes in batches in high-rate mode, ramps
+// up from rampStart to 'rampEnd' if ramp is enabled and is adjusted by
+// adaptive controller if there is one. Connections that aren't limited at
+// all have nothing to ramp up to, so they aren't ramped.
+func (p *proxy) connLimiter(limiter throttle.Limiter, rampEnd rate.Limit, created time.Time,
+	adaptive *adaptiveController) throttle.Limiter {
+	if p.batch > 0 {
+		limiter = throttle.NewBatchLimiter(limiter, p.batch)
+	}
+	if p.ramp > 0 && rampEnd != rate.Inf {
+		limiter = throttle.NewRampLimiter(p.rampStart, rampEnd, created, p.ramp, limiter)
+	}
+	if adaptive != nil {
+		limiter = adaptive.wrap(limiter)
+	}
+	return limiter
+}
+
+// Closes connection once given duration elapses unless it gets closed
+// earlier. Lifetime is recorded as the reason connection is closed for.
+func expireAfter(conn *throttle.LimitedConnection, d time.Duration, reason *closeReason) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		log.Printf("Closing connection to %v: maximum lifetime of %v exceeded", conn.RemoteAddr(), d)
+		reason.set(closeReasonLifetime)
+		conn.Close()
+	case <-conn.Done():
+	}
+}
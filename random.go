@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// Kinds of random rate distributions
+const (
+	distUniform = "uniform"
+	distLog     = "log"
+	distChoice  = "choice"
+)
+
+// rateDistribution draws random rates of connections
+type rateDistribution struct {
+	kind     string
+	min, max rate.Limit
+	choices  []rate.Limit
+}
+
+// parseRateDistribution parses distribution like 'uniform:64Kbps-10Mbps',
+// 'log:64Kbps-10Mbps' or 'choice:256Kbps,1Mbps,10Mbps'
+func parseRateDistribution(s string) (*rateDistribution, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Bad rate distribution %q, expected <kind>:<rates>", s)
+	}
+	d := &rateDistribution{kind: parts[0]}
+	switch d.kind {
+	case distUniform, distLog:
+		bounds := strings.SplitN(parts[1], "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Bad rate range %q, expected <min>-<max>", parts[1])
+		}
+		min, err := throttle.ParseBandwidth(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		max, err := throttle.ParseBandwidth(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		if min <= 0 || max < min {
+			return nil, fmt.Errorf("Bad rate range %q, expected positive min not greater than max", parts[1])
+		}
+		d.min, d.max = min, max
+	case distChoice:
+		for _, s := range strings.Split(parts[1], ",") {
+			l, err := throttle.ParseRate(s)
+			if err != nil {
+				return nil, err
+			}
+			d.choices = append(d.choices, l)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown rate distribution %q, expected %s, %s or %s", d.kind,
+			distUniform, distLog, distChoice)
+	}
+	return d, nil
+}
+
+// draw returns a random rate
+func (d *rateDistribution) draw() rate.Limit {
+	switch d.kind {
+	case distUniform:
+		return d.min + rate.Limit(rand.Float64())*(d.max-d.min)
+	case distLog:
+		return d.min * rate.Limit(math.Pow(float64(d.max/d.min), rand.Float64()))
+	default:
+		return d.choices[rand.Intn(len(d.choices))]
+	}
+}
+
+// formatRate formats rate using binary units
+func formatRate(l rate.Limit) string {
+	if l == rate.Inf {
+		return throttle.Unlimited
+	}
+	if l < 1024 {
+		// Fractions of a byte matter at rates of IoT links
+		return strconv.FormatFloat(float64(l), 'g', 4, 64) + "B/s"
+	}
+	return formatBytes(int64(l)) + "/s"
+}
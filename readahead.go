@@ -0,0 +1,207 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+)
+
+// readAheadChunk is data read ahead into a buffer, partially consumed up to
+// off
+type readAheadChunk struct {
+	buf []byte
+	off int
+}
+
+// readAheadConn is a net.Conn wrapping connection to destination that keeps
+// reading from it into a bounded buffer while the throttled side waits for
+// its limiter, so that short stalls of the destination don't add up with
+// throttle waits. Buffers are taken from buffer budget if there is one and
+// reading ahead pauses while the budget is exhausted. Read deadlines are
+// handled by readAheadConn itself.
+type readAheadConn struct {
+	net.Conn
+	// size is the total size of buffers connection may hold at once
+	size   int
+	budget *throttle.BufferBudget
+
+	mu     sync.Mutex
+	chunks []readAheadChunk
+	// held is the total size of buffers of chunks
+	held int
+	// err is the error reading from inner connection failed with. It's
+	// returned once chunks are drained.
+	err          error
+	closed       bool
+	readDeadline time.Time
+
+	// data is signalled when chunks or err are added
+	data chan struct{}
+	// space is signalled when chunks are consumed
+	space chan struct{}
+	// deadline is signalled when read deadline changes, so that blocked
+	// Read takes the new one
+	deadline  chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newReadAheadConn(inner net.Conn, size int, budget *throttle.BufferBudget) *readAheadConn {
+	c := &readAheadConn{
+		Conn:     inner,
+		size:     size,
+		budget:   budget,
+		data:     make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+		deadline: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// wake wakes up whoever waits on ch without blocking
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *readAheadConn) getBuffer() []byte {
+	if c.budget != nil {
+		return c.budget.Get()
+	}
+	return make([]byte, 0, throttle.MaxBufferSize)
+}
+
+func (c *readAheadConn) putBuffer(buf []byte) {
+	if c.budget != nil {
+		c.budget.Put(buf)
+	}
+}
+
+// full returns whether reading ahead has to wait for chunks to be consumed.
+// At least one chunk is always read ahead.
+func (c *readAheadConn) full() bool {
+	if c.held == 0 {
+		return false
+	}
+	return c.held >= c.size || (c.budget != nil && c.budget.Used() >= c.budget.Max())
+}
+
+// Reads from inner connection into chunks until it fails or connection is
+// closed
+func (c *readAheadConn) readLoop() {
+	for {
+		c.mu.Lock()
+		for c.full() && !c.closed {
+			c.mu.Unlock()
+			select {
+			case <-c.space:
+			case <-c.done:
+				return
+			}
+			c.mu.Lock()
+		}
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+
+		buf := c.getBuffer()
+		n, err := c.Conn.Read(buf[:cap(buf)])
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			c.putBuffer(buf)
+			return
+		}
+		if n > 0 {
+			c.chunks = append(c.chunks, readAheadChunk{buf: buf[:n]})
+			c.held += cap(buf)
+		} else {
+			c.putBuffer(buf)
+		}
+		c.err = err
+		c.mu.Unlock()
+		wake(c.data)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *readAheadConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.chunks) == 0 && c.err == nil {
+		deadline, stop := deadlineTimer(c.readDeadline)
+		c.mu.Unlock()
+		select {
+		case <-c.data:
+		case <-c.deadline:
+		case <-deadline:
+			return 0, timeoutError{}
+		case <-c.done:
+			stop()
+			return 0, io.ErrClosedPipe
+		}
+		stop()
+		c.mu.Lock()
+	}
+	if len(c.chunks) == 0 {
+		err := c.err
+		c.mu.Unlock()
+		return 0, err
+	}
+	head := &c.chunks[0]
+	n := copy(b, head.buf[head.off:])
+	head.off += n
+	if head.off == len(head.buf) {
+		c.held -= cap(head.buf)
+		c.putBuffer(head.buf)
+		c.chunks[0] = readAheadChunk{}
+		c.chunks = c.chunks[1:]
+	}
+	c.mu.Unlock()
+	wake(c.space)
+	return n, nil
+}
+
+// CloseWrite shuts down writing side of the underlying connection
+func (c *readAheadConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *readAheadConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *readAheadConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	wake(c.deadline)
+	return nil
+}
+
+// Close returns buffers of data that hasn't been read to budget and closes
+// the underlying connection
+func (c *readAheadConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		for _, chunk := range c.chunks {
+			c.putBuffer(chunk.buf)
+		}
+		c.chunks, c.held = nil, 0
+		c.mu.Unlock()
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
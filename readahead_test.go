@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadAheadSetReadDeadlineWakesRead(t *testing.T) {
+	inner, peer := net.Pipe()
+	defer peer.Close()
+	c := newReadAheadConn(inner, 64*1024, nil)
+	defer c.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1024))
+		errs <- err
+	}()
+	// Let Read block without a deadline first
+	time.Sleep(50 * time.Millisecond)
+	c.SetReadDeadline(time.Now())
+	select {
+	case err := <-errs:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Read failed with %v, expected timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read wasn't interrupted by deadline set while it was blocked")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sides of a recorded session
+const (
+	fromClient = "client"
+	fromServer = "server"
+)
+
+// sessionHeader is the first line of a session recording
+type sessionHeader struct {
+	Destination string    `json:"destination"`
+	Client      string    `json:"client"`
+	User        string    `json:"user"`
+	Start       time.Time `json:"start"`
+}
+
+// sessionEvent is a line of a session recording following the header:
+// either a chunk of data sent by one of the sides or a side closing its
+// sending direction
+type sessionEvent struct {
+	// Offset is the time elapsed since session start
+	Offset time.Duration `json:"offset"`
+	From   string        `json:"from"`
+	Data   []byte        `json:"data,omitempty"`
+	Close  bool          `json:"close,omitempty"`
+}
+
+// recordConn is a net.Conn wrapping connection to destination that records
+// timing and payload of everything relayed through it as JSON lines
+type recordConn struct {
+	net.Conn
+	start time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	enc    *json.Encoder
+	closed map[string]bool
+	err    error
+}
+
+// newRecordConn creates a session recording in dir and wraps connection so
+// that its traffic is recorded
+func newRecordConn(inner net.Conn, dir string, meta connMeta) (*recordConn, error) {
+	dest := net.JoinHostPort(meta.host, fmt.Sprint(meta.port))
+	start := time.Now()
+	name := fmt.Sprintf("%s-%s.session", start.Format("20060102T150405.000000000"),
+		strings.NewReplacer(":", "_", "/", "_").Replace(dest))
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create session recording: %w", err)
+	}
+	c := &recordConn{Conn: inner, start: start, f: f, w: bufio.NewWriter(f), closed: make(map[string]bool)}
+	c.enc = json.NewEncoder(c.w)
+	c.err = c.enc.Encode(sessionHeader{Destination: dest, Client: meta.client, User: meta.tag, Start: start})
+	return c, nil
+}
+
+// record appends an event. Once writing fails, the error is reported and the
+// rest of the session isn't recorded.
+func (c *recordConn) record(e sessionEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.f == nil || c.closed[e.From] {
+		return
+	}
+	if e.Close {
+		c.closed[e.From] = true
+	}
+	e.Offset = time.Since(c.start)
+	if c.err = c.enc.Encode(e); c.err != nil {
+		log.Printf("Failed to record session to %s: %v", c.f.Name(), c.err)
+	}
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(sessionEvent{From: fromServer, Data: b[:n]})
+	}
+	if err == io.EOF {
+		c.record(sessionEvent{From: fromServer, Close: true})
+	}
+	return n, err
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(sessionEvent{From: fromClient, Data: b[:n]})
+	}
+	return n, err
+}
+
+func (c *recordConn) CloseWrite() error {
+	err := closeWrite(c.Conn)
+	if err == nil {
+		c.record(sessionEvent{From: fromClient, Close: true})
+	}
+	return err
+}
+
+func (c *recordConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f != nil {
+		if ferr := c.w.Flush(); ferr != nil && c.err == nil {
+			log.Printf("Failed to record session to %s: %v", c.f.Name(), ferr)
+		}
+		c.f.Close()
+		c.f = nil
+	}
+	return err
+}
+
+// readSession reads session recording
+func readSession(path string) (sessionHeader, []sessionEvent, error) {
+	var header sessionHeader
+	var events []sessionEvent
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if err := dec.Decode(&header); err != nil {
+		return header, nil, fmt.Errorf("Failed to read session header from %s: %w", path, err)
+	}
+	for {
+		var e sessionEvent
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return header, events, nil
+		}
+		if err != nil {
+			return header, nil, fmt.Errorf("Failed to read session event from %s: %w", path, err)
+		}
+		events = append(events, e)
+	}
+}
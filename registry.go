@@ -0,0 +1,287 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// connMeta describes where a proxied connection comes from
+type connMeta struct {
+	// client is the address of the SOCKS client
+	client string
+	// tag is the username client has authenticated with (if any)
+	tag string
+	// host is destination host name (or IP address) as requested by client
+	host string
+	// port is destination port as requested by client
+	port int
+	// rateHint is the rate of the connection requested by client in its
+	// username. Zero if not requested.
+	rateHint rate.Limit
+	// class is the rate class assigned to connection by policy, script or
+	// hook (if any)
+	class string
+	// rate is the limit of connection alone chosen by script or hook. Zero
+	// if not chosen.
+	rate rate.Limit
+	// clientConn is the connection of the client if it's known
+	clientConn net.Conn
+	// listener is the configured address of the listener connection was
+	// accepted on
+	listener string
+	// adaptive throttles connection while path to destination is congested
+	// if adaptive throttling is enabled
+	adaptive *adaptiveController
+	// closeReason is why the proxy has closed the connection by itself
+	closeReason *closeReason
+	// Number and organization of autonomous system of the destination if
+	// ASN database is set. Zero number means it's unknown.
+	asn   uint
+	asOrg string
+	// rule is the position of the rule applied to connection, zero if none
+	rule int
+	// throttling is what limits connection. It's shared by copies of meta
+	// since sniffing may change it once connection is registered.
+	throttling *connThrottling
+}
+
+// connThrottling is what limits a connection: the name of its limiter like
+// "global", "class:bulk" or "rule:2" and the rate connection gets at most
+// (rate.Inf if it's unlimited)
+type connThrottling struct {
+	mu        sync.Mutex
+	limitedBy string
+	rate      rate.Limit
+}
+
+func (t *connThrottling) set(limitedBy string, r rate.Limit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limitedBy, t.rate = limitedBy, r
+}
+
+func (t *connThrottling) get() (string, rate.Limit) {
+	if t == nil {
+		return "", 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limitedBy, t.rate
+}
+
+// usageKey is the combination of connection attributes traffic is
+// accumulated by
+type usageKey struct {
+	tag         string
+	destination string
+	listener    string
+	// asn is autonomous system of the destination formatted by formatASN
+	asn string
+}
+
+func (m connMeta) usageKey() usageKey {
+	return usageKey{
+		tag:         m.tag,
+		destination: net.JoinHostPort(m.host, strconv.Itoa(m.port)),
+		listener:    m.listener,
+		asn:         formatASN(m.asn, m.asOrg),
+	}
+}
+
+// tagTotals is traffic accounted for a single tag
+type tagTotals struct {
+	Connections  int64
+	BytesRead    int64
+	BytesWritten int64
+	WaitTime     time.Duration
+}
+
+// plus returns sum of two totals
+func (t tagTotals) plus(o tagTotals) tagTotals {
+	return tagTotals{
+		Connections:  t.Connections + o.Connections,
+		BytesRead:    t.BytesRead + o.BytesRead,
+		BytesWritten: t.BytesWritten + o.BytesWritten,
+		WaitTime:     t.WaitTime + o.WaitTime,
+	}
+}
+
+// minus returns difference between two totals
+func (t tagTotals) minus(o tagTotals) tagTotals {
+	return tagTotals{
+		Connections:  t.Connections - o.Connections,
+		BytesRead:    t.BytesRead - o.BytesRead,
+		BytesWritten: t.BytesWritten - o.BytesWritten,
+		WaitTime:     t.WaitTime - o.WaitTime,
+	}
+}
+
+func (t *tagTotals) add(stats throttle.ConnectionStats) {
+	t.Connections++
+	t.BytesRead += stats.BytesRead
+	t.BytesWritten += stats.BytesWritten
+	t.WaitTime += stats.WaitTime
+}
+
+// connRegistry keeps track of live limited connections so that they can be
+// inspected through the admin API. It also accumulates traffic of closed
+// connections per tag and, if usage is collected, per tag, destination and
+// listener until it's taken.
+type connRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]registeredConn
+	// closedTags holds totals of closed connections per tag since start
+	closedTags map[string]tagTotals
+	// closed holds traffic of closed connections not taken by takeUsage
+	// yet. It's nil unless usage is collected.
+	closed map[usageKey]tagTotals
+	// flows get a row for every closed connection if set
+	flows *flowLog
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns:      make(map[uint64]registeredConn),
+		closedTags: make(map[string]tagTotals),
+	}
+}
+
+// collectUsage makes registry keep traffic per usageKey for takeUsage.
+// Whoever calls it has to take usage regularly, since it's only forgotten
+// once taken.
+func (r *connRegistry) collectUsage() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed == nil {
+		r.closed = make(map[usageKey]tagTotals)
+	}
+}
+
+// add registers connection and returns its identifier. Connection is removed
+// from registry once it's closed.
+func (r *connRegistry) add(c *throttle.LimitedConnection, meta connMeta) uint64 {
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.conns[id] = registeredConn{id: id, meta: meta, conn: c, taken: &tagTotals{}}
+	r.mu.Unlock()
+
+	go func() {
+		<-c.Done()
+		stats := c.Stats()
+		var totals tagTotals
+		totals.add(stats)
+		key := meta.usageKey()
+		r.mu.Lock()
+		taken := *r.conns[id].taken
+		delete(r.conns, id)
+		r.closedTags[key.tag] = r.closedTags[key.tag].plus(totals)
+		if r.closed != nil {
+			r.closed[key] = r.closed[key].plus(totals.minus(taken))
+		}
+		r.mu.Unlock()
+		closed := "closed"
+		if reason := meta.closeReason.get(); reason != closeReasonClosed {
+			closed += " (" + reason + ")"
+		}
+		logClosed.Printf("Connection from %s (tag %q) to %s %s: read %s, written %s in %v",
+			meta.client, meta.tag, key.destination, closed, formatBytes(stats.BytesRead),
+			formatBytes(stats.BytesWritten), time.Since(stats.Created).Round(time.Millisecond))
+		if r.flows != nil {
+			r.flows.record(meta, stats, time.Now())
+		}
+	}()
+	return id
+}
+
+// count returns the number of live connections
+func (r *connRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// registeredConn is a live connection along with its registry identifier
+type registeredConn struct {
+	id   uint64
+	meta connMeta
+	conn *throttle.LimitedConnection
+	// taken is the traffic of connection taken by takeUsage so far
+	taken *tagTotals
+}
+
+// get returns live connection by its identifier
+func (r *connRegistry) get(id uint64) (registeredConn, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.conns[id]
+	return c, ok
+}
+
+// list returns live connections ordered by identifier
+func (r *connRegistry) list() []registeredConn {
+	r.mu.Lock()
+	res := make([]registeredConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		res = append(res, c)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+	return res
+}
+
+// takeUsage returns traffic of both live and closed connections since the
+// previous call grouped by usageKey and forgets traffic of closed ones.
+// Usage has to be collected for it to include closed connections.
+func (r *connRegistry) takeUsage() map[usageKey]tagTotals {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.closed
+	if res == nil {
+		res = make(map[usageKey]tagTotals)
+	} else {
+		r.closed = make(map[usageKey]tagTotals)
+	}
+	for _, c := range r.conns {
+		var totals tagTotals
+		totals.add(c.conn.Stats())
+		delta := totals.minus(*c.taken)
+		if delta == (tagTotals{}) {
+			continue
+		}
+		*c.taken = totals
+		key := c.meta.usageKey()
+		res[key] = res[key].plus(delta)
+	}
+	return res
+}
+
+// tags returns traffic totals per tag for both live and closed connections
+func (r *connRegistry) tags() map[string]tagTotals {
+	r.mu.Lock()
+	res := make(map[string]tagTotals, len(r.closedTags))
+	for tag, totals := range r.closedTags {
+		res[tag] = totals
+	}
+	live := make([]registeredConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		live = append(live, c)
+	}
+	r.mu.Unlock()
+
+	for _, c := range live {
+		tag := c.meta.tag
+		totals := res[tag]
+		totals.add(c.conn.Stats())
+		res[tag] = totals
+	}
+	return res
+}
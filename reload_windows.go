@@ -0,0 +1,5 @@
+package main
+
+// notifyReload does nothing since Windows has no SIGHUP
+func notifyReload(reload func()) {
+}
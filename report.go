@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// reportEntry is traffic of a single user or destination summed over
+// rollups
+type reportEntry struct {
+	key          string
+	connections  int64
+	bytesRead    int64
+	bytesWritten int64
+	waitTime     float64
+}
+
+func (e reportEntry) bytes() int64 {
+	return e.bytesRead + e.bytesWritten
+}
+
+// runReport runs report mode: it reads traffic rollups and prints top users
+// and destinations by traffic and by time spent waiting for limiters
+func runReport(args []string) {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	var rollupDir = flags.String("rollup-dir", "", "Directory with traffic rollups written by the proxy")
+	var since = flags.Duration("since", 24*time.Hour, "How far back to look")
+	var top = flags.Int("top", 10, "Number of entries to print in every table")
+	flags.Parse(args)
+
+	if *rollupDir == "" {
+		log.Fatal("Please set rollup-dir")
+	}
+
+	records, err := readRollups(*rollupDir, time.Now().Add(-*since))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, dimension := range []string{dimensionUser, dimensionDestination, dimensionASN} {
+		entries := sumRollups(records, dimension)
+		if dimension == dimensionASN && len(entries) == 0 {
+			// Proxy has no ASN database
+			continue
+		}
+
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].bytes() > entries[j].bytes() })
+		printReport(fmt.Sprintf("Top %ss by traffic", dimension), entries, *top)
+
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].waitTime > entries[j].waitTime })
+		printReport(fmt.Sprintf("Top %ss by throttle wait time", dimension), entries, *top)
+	}
+}
+
+// sumRollups sums rollup records of a dimension per key. Entries are
+// ordered by key.
+func sumRollups(records []rollupRecord, dimension string) []reportEntry {
+	byKey := make(map[string]*reportEntry)
+	for _, r := range records {
+		if r.Dimension != dimension {
+			continue
+		}
+		e, ok := byKey[r.Key]
+		if !ok {
+			e = &reportEntry{key: r.Key}
+			byKey[r.Key] = e
+		}
+		e.connections += r.Connections
+		e.bytesRead += r.BytesRead
+		e.bytesWritten += r.BytesWritten
+		e.waitTime += r.WaitTime
+	}
+	res := make([]reportEntry, 0, len(byKey))
+	for _, e := range byKey {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].key < res[j].key })
+	return res
+}
+
+func printReport(title string, entries []reportEntry, top int) {
+	fmt.Printf("%s:\n", title)
+	if len(entries) > top {
+		entries = entries[:top]
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tCONNECTIONS\tREAD\tWRITTEN\tWAIT")
+	for _, e := range entries {
+		key := e.key
+		if key == "" {
+			key = "-"
+		}
+		fmt.Fprintf(w, "  %s\t%d\t%s\t%s\t%v\n", key, e.connections,
+			formatBytes(e.bytesRead), formatBytes(e.bytesWritten),
+			time.Duration(e.waitTime*float64(time.Second)).Round(time.Millisecond))
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// formatBytes formats byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,4 @@
+package main
+
+// SO_REUSEPORT is missing from syscall package on Linux
+const soReusePort = 0xf
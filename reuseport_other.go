@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenReusePort(network, addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Supported rollup file formats
+const (
+	rollupCSV  = "csv"
+	rollupJSON = "json"
+)
+
+// Dimensions traffic is aggregated by in rollups
+const (
+	dimensionUser        = "user"
+	dimensionDestination = "destination"
+	dimensionListener    = "listener"
+	dimensionASN         = "asn"
+)
+
+// rollupTimeFormat is used for rollup file names so that they sort
+// chronologically
+const rollupTimeFormat = "20060102T150405Z"
+
+// rollupRecord is traffic accounted for a single key of a dimension during
+// rollup period
+type rollupRecord struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Dimension    string    `json:"dimension"`
+	Key          string    `json:"key"`
+	Connections  int64     `json:"connections"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+	// Total time spent waiting for the limiter, in seconds
+	WaitTime float64 `json:"wait_time"`
+}
+
+var rollupCSVHeader = []string{"start", "end", "dimension", "key", "connections",
+	"bytes_read", "bytes_written", "wait_time"}
+
+// rollupWriter periodically writes traffic accounted since previous rollup
+// to timestamped files in a directory
+type rollupWriter struct {
+	registry *connRegistry
+	dir      string
+	format   string
+	start    time.Time
+}
+
+func newRollupWriter(registry *connRegistry, dir, format string) (*rollupWriter, error) {
+	if format != rollupCSV && format != rollupJSON {
+		return nil, fmt.Errorf("Unknown rollup format %q, expected %q or %q", format, rollupCSV, rollupJSON)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	registry.collectUsage()
+	return &rollupWriter{
+		registry: registry,
+		dir:      dir,
+		format:   format,
+		start:    time.Now().UTC(),
+	}, nil
+}
+
+// run writes a rollup every interval. It never returns.
+func (w *rollupWriter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := w.write(time.Now().UTC()); err != nil {
+			log.Printf("Failed to write rollup: %v", err)
+		}
+	}
+}
+
+// write writes traffic accounted since previous rollup into a new file
+func (w *rollupWriter) write(now time.Time) error {
+	records := w.collect(now)
+	name := filepath.Join(w.dir, fmt.Sprintf("throttlesocks-%s.%s", now.Format(rollupTimeFormat), w.format))
+	tmp, err := ioutil.TempFile(w.dir, ".rollup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if w.format == rollupCSV {
+		err = writeRollupCSV(tmp, records)
+	} else {
+		err = json.NewEncoder(tmp).Encode(records)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// collect computes per-dimension traffic since previous call
+func (w *rollupWriter) collect(now time.Time) []rollupRecord {
+	grouped := make(map[[2]string]tagTotals)
+	for key, delta := range w.registry.takeUsage() {
+		for _, k := range [][2]string{
+			{dimensionUser, key.tag},
+			{dimensionDestination, key.destination},
+			{dimensionListener, key.listener},
+		} {
+			grouped[k] = grouped[k].plus(delta)
+		}
+		// Autonomous systems are only known if ASN database is set
+		if key.asn != "" {
+			k := [2]string{dimensionASN, key.asn}
+			grouped[k] = grouped[k].plus(delta)
+		}
+	}
+
+	records := make([]rollupRecord, 0, len(grouped))
+	for k, totals := range grouped {
+		records = append(records, rollupRecord{
+			Start:        w.start,
+			End:          now,
+			Dimension:    k[0],
+			Key:          k[1],
+			Connections:  totals.Connections,
+			BytesRead:    totals.BytesRead,
+			BytesWritten: totals.BytesWritten,
+			WaitTime:     totals.WaitTime.Seconds(),
+		})
+	}
+	w.start = now
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Dimension != records[j].Dimension {
+			return records[i].Dimension < records[j].Dimension
+		}
+		return records[i].Key < records[j].Key
+	})
+	return records
+}
+
+func writeRollupCSV(out io.Writer, records []rollupRecord) error {
+	cw := csv.NewWriter(out)
+	cw.Write(rollupCSVHeader)
+	for _, r := range records {
+		cw.Write([]string{
+			r.Start.Format(time.RFC3339),
+			r.End.Format(time.RFC3339),
+			r.Dimension,
+			r.Key,
+			strconv.FormatInt(r.Connections, 10),
+			strconv.FormatInt(r.BytesRead, 10),
+			strconv.FormatInt(r.BytesWritten, 10),
+			strconv.FormatFloat(r.WaitTime, 'f', 3, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readRollups reads records of all rollups in dir that ended after since
+func readRollups(dir string, since time.Time) ([]rollupRecord, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "throttlesocks-*.*"))
+	if err != nil {
+		return nil, err
+	}
+	var res []rollupRecord
+	for _, name := range names {
+		records, err := readRollupFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if r.End.After(since) {
+				res = append(res, r)
+			}
+		}
+	}
+	return res, nil
+}
+
+func readRollupFile(name string) ([]rollupRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []rollupRecord
+	switch filepath.Ext(name) {
+	case "." + rollupJSON:
+		err = json.NewDecoder(f).Decode(&records)
+	case "." + rollupCSV:
+		records, err = readRollupCSV(f)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read rollup %s: %w", name, err)
+	}
+	return records, nil
+}
+
+func readRollupCSV(in io.Reader) ([]rollupRecord, error) {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = len(rollupCSVHeader)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	records := make([]rollupRecord, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		var r rollupRecord
+		var errs [6]error
+		r.Start, errs[0] = time.Parse(time.RFC3339, row[0])
+		r.End, errs[1] = time.Parse(time.RFC3339, row[1])
+		r.Dimension, r.Key = row[2], row[3]
+		r.Connections, errs[2] = strconv.ParseInt(row[4], 10, 64)
+		r.BytesRead, errs[3] = strconv.ParseInt(row[5], 10, 64)
+		r.BytesWritten, errs[4] = strconv.ParseInt(row[6], 10, 64)
+		r.WaitTime, errs[5] = strconv.ParseFloat(row[7], 64)
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
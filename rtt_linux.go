@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// probeRTT returns round-trip time of a TCP connection as estimated by
+// kernel. The larger of sender and receiver estimates is returned, so that
+// congestion is noticed whichever way data mostly flows.
+func probeRTT(c syscall.Conn) (time.Duration, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, fmt.Errorf("Failed to get TCP_INFO: %w", sockErr)
+	}
+	rtt := info.Rtt
+	if info.Rcv_rtt > rtt {
+		rtt = info.Rcv_rtt
+	}
+	return time.Duration(rtt) * time.Microsecond, nil
+}
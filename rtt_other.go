@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+func probeRTT(c syscall.Conn) (time.Duration, error) {
+	return 0, fmt.Errorf("Probing RTT is not supported on this platform")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// rule selects proxied connections and defines how they are handled. Rule
+// is written as space-separated key=value pairs, for example
+// "host=*.example.com port=443 user=job1 rate=2Mbps".
+type rule struct {
+	// host is a glob pattern matched against destination host name (or IP
+	// address if client hasn't provided a name)
+	host string
+	// Destination port range, both ends inclusive. Zero maxPort matches any
+	// port.
+	minPort int
+	maxPort int
+	// user is matched against connection tag
+	user string
+	// asn is matched against autonomous system of the destination if it's
+	// non-zero
+	asn uint
+	// mirror is a sink receiving a copy of connection traffic
+	mirror *sink
+	// segment limits size of every read and write of matching connections
+	segment int
+	// Matching connections are reset along with their clients once
+	// resetAfter elapses or resetBytes are transferred (if non-zero)
+	resetAfter time.Duration
+	resetBytes int64
+	// record is a directory sessions of matching connections are recorded
+	// into
+	record string
+	// pcap is the path of a capture file matching connections are recorded
+	// into
+	pcap string
+	// Rate and ceiling of matching connections. If rate is zero, global
+	// limiter is used. If ceiling is set, matching connections may borrow
+	// bandwidth unused by others up to the ceiling.
+	rate rate.Limit
+	ceil rate.Limit
+	// class is the name of a rate class used instead of rate and ceiling
+	class string
+	// limiter is shared by all connections matching the rule. It's created
+	// by ruleList.createLimiters.
+	limiter throttle.Limiter
+	// hits counts connections the rule has applied to. It's shared by
+	// copies of the rule.
+	hits *uint64
+}
+
+// parseRule parses rule from its string representation
+func parseRule(s string) (rule, error) {
+	r := rule{hits: new(uint64)}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return r, fmt.Errorf("Empty rule")
+	}
+	for _, f := range fields {
+		eq := strings.IndexByte(f, '=')
+		if eq < 0 {
+			return r, fmt.Errorf("Failed to parse %q in rule %q: expected key=value", f, s)
+		}
+		key, value := f[:eq], f[eq+1:]
+		switch key {
+		case "host":
+			if _, err := path.Match(value, ""); err != nil {
+				return r, fmt.Errorf("Bad host pattern %q in rule %q: %w", value, s, err)
+			}
+			r.host = value
+		case "port":
+			minPort, maxPort, err := parsePortRange(value)
+			if err != nil {
+				return r, fmt.Errorf("Bad port range in rule %q: %w", s, err)
+			}
+			r.minPort, r.maxPort = minPort, maxPort
+		case "user":
+			r.user = value
+		case "asn":
+			n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+			if err != nil || n == 0 {
+				return r, fmt.Errorf("Bad asn %q in rule %q", value, s)
+			}
+			r.asn = uint(n)
+		case "rate":
+			limit, err := throttle.ParseRate(value)
+			if err != nil {
+				return r, fmt.Errorf("Bad rate in rule %q: %w", s, err)
+			}
+			r.rate = limit
+		case "ceil":
+			limit, err := throttle.ParseRate(value)
+			if err != nil {
+				return r, fmt.Errorf("Bad ceil in rule %q: %w", s, err)
+			}
+			r.ceil = limit
+		case "class":
+			r.class = value
+		case "mirror":
+			sink, err := parseSink(value)
+			if err != nil {
+				return r, fmt.Errorf("Bad mirror in rule %q: %w", s, err)
+			}
+			r.mirror = &sink
+		case "segment":
+			n, err := strconv.ParseUint(value, 10, 31)
+			if err != nil || n == 0 {
+				return r, fmt.Errorf("Bad segment %q in rule %q", value, s)
+			}
+			r.segment = int(n)
+		case "reset-after":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return r, fmt.Errorf("Bad reset-after %q in rule %q", value, s)
+			}
+			r.resetAfter = d
+		case "reset-bytes":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return r, fmt.Errorf("Bad reset-bytes %q in rule %q", value, s)
+			}
+			r.resetBytes = n
+		case "record":
+			r.record = value
+		case "pcap":
+			r.pcap = value
+		default:
+			return r, fmt.Errorf("Unknown key %q in rule %q", key, s)
+		}
+	}
+	if r.class != "" && r.rate != 0 {
+		return r, fmt.Errorf("Rule %q has both rate and class", s)
+	}
+	if r.ceil != 0 && r.rate == 0 {
+		return r, fmt.Errorf("Rule %q has ceil without rate", s)
+	}
+	if r.ceil != 0 && r.ceil < r.rate {
+		return r, fmt.Errorf("Rule %q has ceil lower than rate", s)
+	}
+	return r, nil
+}
+
+// Parses either a single port ("443") or an inclusive range ("8000-8999")
+func parsePortRange(s string) (int, int, error) {
+	from, to := s, s
+	if dash := strings.IndexByte(s, '-'); dash >= 0 {
+		from, to = s[:dash], s[dash+1:]
+	}
+	minPort, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to parse %q", s)
+	}
+	maxPort, err := strconv.ParseUint(to, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to parse %q", s)
+	}
+	if minPort == 0 {
+		// Rules without ports have zero range, so port 0 would match any port
+		return 0, 0, fmt.Errorf("Port 0 in %q, ports start from 1", s)
+	}
+	if minPort > maxPort {
+		return 0, 0, fmt.Errorf("Empty port range %q", s)
+	}
+	return int(minPort), int(maxPort), nil
+}
+
+// matches checks whether rule applies to a connection to given host and
+// port in given autonomous system made by a client with given tag
+func (r *rule) matches(host string, port int, tag string, asn uint) bool {
+	if r.host != "" {
+		if ok, _ := path.Match(r.host, host); !ok {
+			return false
+		}
+	}
+	if r.maxPort != 0 && (port < r.minPort || port > r.maxPort) {
+		return false
+	}
+	if r.user != "" && r.user != tag {
+		return false
+	}
+	if r.asn != 0 && r.asn != asn {
+		return false
+	}
+	return true
+}
+
+// hit counts a connection the rule has applied to
+func (r *rule) hit() {
+	atomic.AddUint64(r.hits, 1)
+}
+
+// hitCount returns the number of connections the rule has applied to
+func (r *rule) hitCount() uint64 {
+	return atomic.LoadUint64(r.hits)
+}
+
+// ruleList is a flag.Value accumulating rules from repeated flags
+type ruleList []rule
+
+func (l *ruleList) String() string {
+	return fmt.Sprintf("%d rules", len(*l))
+}
+
+func (l *ruleList) Set(s string) error {
+	r, err := parseRule(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// match returns the first rule matching a connection or nil if none match
+func (l ruleList) match(host string, port int, tag string, asn uint) *rule {
+	for i := range l {
+		if l[i].matches(host, port, tag, asn) {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// matchASN reports whether any rule matches autonomous systems
+func (l ruleList) matchASN() bool {
+	for i := range l {
+		if l[i].asn != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// position returns 1-based position of a rule returned by match
+func (l ruleList) position(r *rule) int {
+	for i := range l {
+		if &l[i] == r {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// createLimiters creates limiters of rules that have rate set and looks up
+// limiters of rules referring to classes. Rules with ceiling borrow from
+// 'link'.
+func (l ruleList) createLimiters(link throttle.Limiter, classes classSet) error {
+	for i := range l {
+		switch {
+		case l[i].rate != 0:
+			l[i].limiter = throttle.NewClassLimiter(l[i].rate, l[i].ceil, link)
+		case l[i].class != "":
+			limiter, err := classes.get(l[i].class)
+			if err != nil {
+				return err
+			}
+			l[i].limiter = limiter
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		minPort, maxPort int
+		err      bool
+	}{
+		{s: "443", minPort: 443, maxPort: 443},
+		{s: "1000-2000", minPort: 1000, maxPort: 2000},
+		{s: "1", minPort: 1, maxPort: 1},
+		{s: "65535", minPort: 65535, maxPort: 65535},
+		{s: "0", err: true},
+		{s: "0-10", err: true},
+		{s: "10-5", err: true},
+		{s: "65536", err: true},
+		{s: "1-65536", err: true},
+		{s: "http", err: true},
+		{s: "", err: true},
+	} {
+		minPort, maxPort, err := parsePortRange(c.s)
+		if c.err {
+			if err == nil {
+				t.Errorf("Port range %q is parsed as %d-%d, expected an error", c.s, minPort, maxPort)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed to parse port range %q: %v", c.s, err)
+		} else if minPort != c.minPort || maxPort != c.maxPort {
+			t.Errorf("Port range %q is parsed as %d-%d, expected %d-%d", c.s, minPort, maxPort, c.minPort, c.maxPort)
+		}
+	}
+}
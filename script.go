@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Limits of a single script call. Scripts exceeding them fail, which
+// rejects the connection.
+const (
+	scriptMaxSteps = 1000000
+	scriptTimeout  = time.Second
+)
+
+// scriptReloadInterval is how often script file is checked for changes
+const scriptReloadInterval = 2 * time.Second
+
+// script is a Starlark program deciding how SOCKS connections are handled.
+// It has to define decide(conn) function which is called for every
+// connection and returns None (handle connection as usual), False (reject
+// it) or a dict with optional "allow", "rate" and "class" keys. Scripts
+// can't load modules or access anything outside of their arguments.
+type script struct {
+	path string
+	// count returns the number of active connections
+	count func() int
+
+	mu      sync.Mutex
+	modTime time.Time
+	decideF starlark.Callable
+}
+
+// newScript loads script from a file
+func newScript(path string, count func() int) (*script, error) {
+	s := &script{path: path, count: count}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.load(fi.ModTime()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load compiles and runs script file, replacing currently used decide
+// function
+func (s *script) load(modTime time.Time) error {
+	src, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	thread := s.newThread("load")
+	globals, err := starlark.ExecFile(thread, s.path, src, starlark.StringDict{
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to load script %s: %w", s.path, err)
+	}
+	decideF, ok := globals["decide"].(starlark.Callable)
+	if !ok {
+		return fmt.Errorf("Script %s doesn't define decide function", s.path)
+	}
+	s.mu.Lock()
+	s.modTime = modTime
+	s.decideF = decideF
+	s.mu.Unlock()
+	return nil
+}
+
+// watch reloads script whenever its file changes. Script that fails to
+// load is reported and the previous one is kept.
+func (s *script) watch() {
+	for range time.Tick(scriptReloadInterval) {
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			log.Printf("Failed to check script for changes: %v", err)
+			continue
+		}
+		s.mu.Lock()
+		changed := !fi.ModTime().Equal(s.modTime)
+		s.mu.Unlock()
+		if !changed {
+			continue
+		}
+		if err := s.load(fi.ModTime()); err != nil {
+			log.Print(err)
+			continue
+		}
+		log.Printf("Reloaded script %s", s.path)
+	}
+}
+
+func (s *script) newThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("Script %s: %s", s.path, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	return thread
+}
+
+func (s *script) String() string {
+	return "script " + s.path
+}
+
+// decide calls script for a connection
+func (s *script) decide(meta connMeta) (connDecision, error) {
+	decision := connDecision{allow: true}
+	s.mu.Lock()
+	decideF := s.decideF
+	s.mu.Unlock()
+
+	now := time.Now()
+	conn := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"client":      starlark.String(meta.client),
+		"user":        starlark.String(meta.tag),
+		"host":        starlark.String(meta.host),
+		"port":        starlark.MakeInt(meta.port),
+		"hour":        starlark.MakeInt(now.Hour()),
+		"weekday":     starlark.String(now.Weekday().String()),
+		"connections": starlark.MakeInt(s.count()),
+	})
+	thread := s.newThread(meta.client)
+	timer := time.AfterFunc(scriptTimeout, func() {
+		thread.Cancel("timeout")
+	})
+	defer timer.Stop()
+	res, err := starlark.Call(thread, decideF, starlark.Tuple{conn}, nil)
+	if err != nil {
+		return decision, fmt.Errorf("Script failed: %w", err)
+	}
+
+	switch res := res.(type) {
+	case starlark.NoneType:
+	case starlark.Bool:
+		decision.allow = bool(res)
+	case *starlark.Dict:
+		for _, item := range res.Items() {
+			key, _ := starlark.AsString(item[0])
+			switch key {
+			case "allow":
+				allow, ok := item[1].(starlark.Bool)
+				if !ok {
+					return decision, fmt.Errorf("Script returned non-bool allow %s", item[1])
+				}
+				decision.allow = bool(allow)
+			case "rate":
+				limit, ok := starlark.AsString(item[1])
+				if !ok {
+					return decision, fmt.Errorf("Script returned non-string rate %s", item[1])
+				}
+				decision.rate, err = throttle.ParseRate(limit)
+				if err != nil {
+					return decision, err
+				}
+			case "class":
+				class, ok := starlark.AsString(item[1])
+				if !ok {
+					return decision, fmt.Errorf("Script returned non-string class %s", item[1])
+				}
+				decision.class = class
+			default:
+				return decision, fmt.Errorf("Script returned unknown key %s", item[0])
+			}
+		}
+	default:
+		return decision, fmt.Errorf("Script returned %s, expected None, bool or dict", res.Type())
+	}
+	return decision, nil
+}
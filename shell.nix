@@ -1,12 +1,14 @@
 let nixpkgs = builtins.fetchGit {
       url = "https://github.com/NixOS/nixpkgs.git";
-      ref = "master";
-      rev = "80308388cd77ee58823c9b6f24b46892cd359145";
+      # Release with Go 1.18, which is the minimum Go version dependencies
+      # build with
+      ref = "refs/heads/nixos-22.05";
     };
     pkgs = import nixpkgs {};
 in  pkgs.mkShell {
   hardeningDisable = [ "all" ];
-  buildInputs = [ pkgs.go_1_16 ];
+  # linux-pam lets builds with 'pam' build tag link
+  buildInputs = [ pkgs.go_1_18 pkgs.linux-pam ];
   shellHook = ''
     if [[ -z "$THROTTLESOCKS_GOPATH" ]]; then
       export GOPATH="$(pwd)/.go"
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// Traffic classes detected by sniffing
+const (
+	classTLS     = "tls"
+	classHTTP    = "http"
+	classSSH     = "ssh"
+	classUnknown = "unknown"
+)
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "),
+	[]byte("DELETE "), []byte("OPTIONS "), []byte("PATCH "),
+	[]byte("CONNECT "), []byte("TRACE "), []byte("HTTP/1."),
+}
+
+// classify guesses protocol from the first bytes of a stream
+func classify(b []byte) string {
+	if len(b) >= 2 && b[0] == 0x16 && b[1] == 0x03 {
+		// TLS handshake record
+		return classTLS
+	}
+	if bytes.HasPrefix(b, []byte("SSH-")) {
+		return classSSH
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return classHTTP
+		}
+	}
+	return classUnknown
+}
+
+// parseClassLimits parses comma-separated list of class=limit pairs (for
+// example "tls=1Mbps,ssh=unlimited") into limiters shared by all
+// connections of a class. Limit may have a ceiling ("tls=1Mbps:5Mbps"), in
+// which case class borrows bandwidth from 'link' up to the ceiling.
+func parseClassLimits(s string, link throttle.Limiter) (map[string]throttle.Limiter, error) {
+	res := make(map[string]throttle.Limiter)
+	for _, pair := range strings.Split(s, ",") {
+		eq := strings.IndexByte(pair, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("Failed to parse %q: expected class=limit", pair)
+		}
+		class, limit := pair[:eq], pair[eq+1:]
+		switch class {
+		case classTLS, classHTTP, classSSH, classUnknown:
+		default:
+			return nil, fmt.Errorf("Unknown traffic class %q", class)
+		}
+		var ceil rate.Limit
+		if colon := strings.IndexByte(limit, ':'); colon >= 0 {
+			l, err := throttle.ParseRate(limit[colon+1:])
+			if err != nil {
+				return nil, err
+			}
+			ceil, limit = l, limit[:colon]
+		}
+		l, err := throttle.ParseRate(limit)
+		if err != nil {
+			return nil, err
+		}
+		if ceil != 0 && ceil < l {
+			return nil, fmt.Errorf("Ceiling of class %q is lower than its rate", class)
+		}
+		res[class] = throttle.NewClassLimiter(l, ceil, link)
+	}
+	return res, nil
+}
+
+// sniffConn is a net.Conn that classifies traffic by the first chunk either
+// read or written (depending on which side speaks first). Bytes are only
+// observed, so nothing has to be replayed to either side.
+type sniffConn struct {
+	net.Conn
+	once       sync.Once
+	classified func(class string)
+}
+
+// CloseWrite shuts down writing side of the underlying connection
+func (c *sniffConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func newSniffConn(inner net.Conn, classified func(class string)) *sniffConn {
+	return &sniffConn{Conn: inner, classified: classified}
+}
+
+func (c *sniffConn) observe(b []byte) {
+	c.once.Do(func() {
+		c.classified(classify(b))
+	})
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.observe(b[:n])
+	}
+	return n, err
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	// Classify before writing so that the peer can't respond before limiter
+	// is switched
+	if len(b) > 0 {
+		c.observe(b)
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/thinkgos/go-socks5"
+)
+
+// anyCredentials is a socks5.CredentialStore that accepts any username and
+// password. Username is only used to tag connections for accounting.
+type anyCredentials struct{}
+
+func (anyCredentials) Valid(user, password, userAddr string) bool {
+	return true
+}
+
+type requestKey struct{}
+
+// requestRules is a socks5.RuleSet that permits everything unless listener
+// is in maintenance and makes SOCKS request available to the dial function
+// through context
+type requestRules struct {
+	// maintenance is nil if listeners can't be put into maintenance, like
+	// in client mode
+	maintenance *maintenance
+	listener    string
+}
+
+func (r requestRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if r.maintenance == nil {
+		return context.WithValue(ctx, requestKey{}, req), true
+	}
+	if _, ok := r.maintenance.state(r.listener); ok {
+		logRejected.Printf("Rejecting request from %v: listener %s is in maintenance", req.RemoteAddr, r.listener)
+		return ctx, false
+	}
+	return context.WithValue(ctx, requestKey{}, req), true
+}
+
+// requestFromContext returns SOCKS request stored in context by
+// requestRules or nil if there is none
+func requestFromContext(ctx context.Context) *socks5.Request {
+	req, _ := ctx.Value(requestKey{}).(*socks5.Request)
+	return req
+}
+
+// Returns connection metadata for a SOCKS request
+func requestMeta(req *socks5.Request) connMeta {
+	var meta connMeta
+	if req == nil {
+		return meta
+	}
+	if req.RemoteAddr != nil {
+		meta.client = req.RemoteAddr.String()
+		if a, ok := req.RemoteAddr.(clientAddr); ok {
+			meta.clientConn = a.conn
+		}
+	}
+	if req.AuthContext != nil {
+		meta.tag = req.AuthContext.Payload["username"]
+	}
+	meta.host = requestHost(req)
+	meta.port = requestPort(req)
+	return meta
+}
+
+// requestHost returns destination host name as requested by client or its
+// IP address if client hasn't provided a name
+func requestHost(req *socks5.Request) string {
+	if req == nil || req.RawDestAddr == nil {
+		return ""
+	}
+	if req.RawDestAddr.FQDN != "" {
+		return req.RawDestAddr.FQDN
+	}
+	return req.RawDestAddr.IP.String()
+}
+
+// requestPort returns destination port as requested by client
+func requestPort(req *socks5.Request) int {
+	if req == nil || req.RawDestAddr == nil {
+		return 0
+	}
+	return req.RawDestAddr.Port
+}
+
+// Host name resolution modes
+const (
+	// resolveLocal resolves host names before dialing (socks5 semantics)
+	resolveLocal = "local"
+	// resolveRemote passes host names to the dialer unresolved (socks5h
+	// semantics)
+	resolveRemote = "remote"
+)
+
+// unresolvingResolver is a socks5.NameResolver that leaves host names
+// unresolved so that they are passed to the dialer as is
+type unresolvingResolver struct{}
+
+func (unresolvingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// newResolver creates socks5.NameResolver for given resolution mode
+func newResolver(mode string) (socks5.NameResolver, error) {
+	switch mode {
+	case resolveLocal:
+		return socks5.DNSResolver{}, nil
+	case resolveRemote:
+		return unresolvingResolver{}, nil
+	}
+	return nil, fmt.Errorf("Unknown resolution mode %q, expected %q or %q", mode, resolveLocal, resolveRemote)
+}
+
+// describeResolution tells how destination address of a request was
+// resolved for the access log
+func describeResolution(req *socks5.Request) string {
+	if req == nil || req.RawDestAddr == nil {
+		return "address requested"
+	}
+	if req.DestAddr != nil && req.DestAddr != req.RawDestAddr {
+		return fmt.Sprintf("mapped to %v", req.DestAddr)
+	}
+	if req.RawDestAddr.FQDN == "" {
+		return "address requested"
+	}
+	if req.DestAddr != nil && len(req.DestAddr.IP) != 0 {
+		return fmt.Sprintf("resolved locally to %v", req.DestAddr.IP)
+	}
+	return "passed unresolved"
+}
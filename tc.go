@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// kernelShaper shapes traffic of the proxy in kernel instead of userspace.
+// Root of a network interface gets an HTB qdisc with a single class limited
+// to the global limit (and netem under it emulating link conditions).
+// Sockets of clients and destinations are marked so that a fw filter puts
+// their packets into that class, while all other traffic of the interface
+// bypasses shaping. Both directions are shaped as long as packets to
+// clients and to destinations leave through the interface.
+type kernelShaper struct {
+	dev  string
+	mark int
+}
+
+// Handles of root qdisc, shaping class and netem qdisc under it programmed
+// by kernelShaper
+const (
+	tcHandle      = "1:"
+	tcClass       = "1:1"
+	tcNetemHandle = "10:"
+)
+
+// setup programs tc to limit marked traffic to a given rate and
+// emulate given link conditions. Existing configuration is replaced rather
+// than added to, so that setup can be repeated by a process taking over on
+// upgrade. Configuration stays in place once the process exits.
+func (k kernelShaper) setup(limit rate.Limit, lnk link) error {
+	if limit <= 0 || limit == rate.Inf {
+		return fmt.Errorf("Kernel shaping needs a positive bandwidth limit")
+	}
+	commands := [][]string{
+		// Default class 0 lets unmarked traffic through unshaped
+		{"qdisc", "replace", "dev", k.dev, "root", "handle", tcHandle, "htb", "default", "0"},
+		k.classArgs("replace", limit),
+	}
+	if lnk.streams() {
+		netem := []string{"qdisc", "replace", "dev", k.dev, "parent", tcClass, "handle", tcNetemHandle, "netem"}
+		if lnk.latency > 0 || lnk.jitter > 0 {
+			netem = append(netem, "delay", tcTime(lnk.latency), tcTime(lnk.jitter))
+		}
+		if lnk.loss > 0 {
+			netem = append(netem, "loss", strconv.FormatFloat(lnk.loss*100, 'f', -1, 64)+"%")
+		}
+		commands = append(commands, netem)
+	}
+	commands = append(commands, []string{"filter", "replace", "dev", k.dev, "parent", tcHandle,
+		"protocol", "all", "prio", "1", "handle", strconv.Itoa(k.mark), "fw", "flowid", tcClass})
+	for _, args := range commands {
+		if err := runTC(args); err != nil {
+			return err
+		}
+	}
+	log.Printf("Traffic of the proxy is shaped by kernel on %s to %s", k.dev, formatRate(limit))
+	return nil
+}
+
+// setLimit changes rate of shaping class
+func (k kernelShaper) setLimit(limit rate.Limit) error {
+	return runTC(k.classArgs("change", limit))
+}
+
+// classArgs returns tc arguments applying 'op' to shaping class with a
+// given rate
+func (k kernelShaper) classArgs(op string, limit rate.Limit) []string {
+	// Bits keep precision of rates that aren't whole bytes per second
+	rate := strconv.FormatInt(int64(limit*8), 10) + "bit"
+	return []string{"class", op, "dev", k.dev, "parent", tcHandle, "classid", tcClass, "htb", "rate", rate, "ceil", rate}
+}
+
+// tcTime formats duration the way tc expects it
+func tcTime(d time.Duration) string {
+	return strconv.FormatInt(d.Microseconds(), 10) + "us"
+}
+
+// markConn marks socket of a connection so that its packets are shaped and
+// reports whether it has succeeded
+func (k kernelShaper) markConn(c net.Conn) bool {
+	if err := markSocket(c, k.mark); err != nil {
+		log.Printf("Connection with %v is not shaped by kernel: %v", c.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+// markingListener marks sockets of accepted connections for kernel shaping
+type markingListener struct {
+	net.Listener
+	shaper kernelShaper
+}
+
+func (l markingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.shaper.markConn(c)
+	return c, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func runTC(args []string) error {
+	return fmt.Errorf("Kernel shaping is not supported on this platform")
+}
+
+func markSocket(c interface{}, mark int) error {
+	return fmt.Errorf("Kernel shaping is not supported on this platform")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// tenant is an isolated namespace declared in configuration, for example
+// `tenant "team-a" { socks :1081; limit 20Mbps; user "job1" { class bulk } }`.
+// Tenant has its own SOCKS listeners, forwards, classes, users and rules.
+// Its connections are accounted separately and served by admin API under
+// /tenants/<name>/.
+type tenant struct {
+	name string
+	// socks are tenant's SOCKS listeners
+	socks []socksListener
+	// limit is the bandwidth limit of the tenant. Tenant shares the global
+	// limit if zero.
+	limit rate.Limit
+	// adminToken is required as a bearer token by tenant's admin API if set
+	adminToken string
+	config     *config
+}
+
+// parseTenant parses `tenant` directive. Its block holds tenant's own
+// parameters along with any top-level directives but tenants.
+func parseTenant(d directive) (tenant, error) {
+	var t tenant
+	if len(d.args) != 1 {
+		return t, d.errorf("expected tenant name")
+	}
+	t.name = d.args[0]
+	if t.name == "" || strings.Contains(t.name, "/") {
+		return t, d.errorf("bad tenant name %q", t.name)
+	}
+	var rest []directive
+	for _, p := range d.block {
+		switch p.name {
+		case "socks":
+			l, err := parseSocksListener(p)
+			if err != nil {
+				return t, err
+			}
+			t.socks = append(t.socks, l)
+		case "limit":
+			if len(p.args) != 1 || p.block != nil {
+				return t, p.errorf("expected a single limit")
+			}
+			l, err := throttle.ParseRate(p.args[0])
+			if err != nil {
+				return t, p.errorf("%v", err)
+			}
+			t.limit = l
+		case "admin-token":
+			if len(p.args) != 1 || p.block != nil {
+				return t, p.errorf("expected token")
+			}
+			t.adminToken = p.args[0]
+		case "tenant":
+			return t, p.errorf("tenants can't be nested")
+		default:
+			rest = append(rest, p)
+		}
+	}
+	cfg, err := newConfig(rest)
+	if err != nil {
+		return t, d.errorf("%q: %v", t.name, err)
+	}
+	t.config = cfg
+	if len(t.socks) == 0 && len(cfg.forwards) == 0 && len(cfg.udpForwards) == 0 {
+		return t, d.errorf("tenant %q has no listeners", t.name)
+	}
+	return t, nil
+}
+
+// forTenant creates proxy of a tenant. It shares link conditions, deciders
+// and other process-wide settings with p, but has its own limiters, rules,
+// users and accounting.
+func (p *proxy) forTenant(t tenant) (*proxy, error) {
+	res := *p
+	if t.limit != 0 {
+		res.limiter = newSharedLimiter(t.limit, p.batch > 0)
+		// Kernel only shapes the global limit
+		res.shaper = nil
+	}
+	res.classes = newClassSet(t.config.classes, res.limiter)
+	res.rules = t.config.rules
+	if err := res.rules.createLimiters(res.limiter, res.classes); err != nil {
+		return nil, err
+	}
+	res.userLimiters = make(map[string]throttle.Limiter, len(t.config.userClasses))
+	for user, class := range t.config.userClasses {
+		res.userLimiters[user] = res.classes[class]
+	}
+	res.registry = newConnRegistry()
+	if p.registry != nil {
+		res.registry.flows = p.registry.flows
+	}
+	res.maintenance = newMaintenance()
+	if p.tracer != nil {
+		res.tracer = newLimiterTracer(p.tracer.log)
+	}
+	if p.metrics != nil {
+		res.metrics = newDelayMetrics()
+	}
+	return &res, nil
+}
+
+// tenantAdminHandler guards admin API of a tenant with its admin token. The
+// dashboard page itself is served to anyone.
+func tenantAdminHandler(t tenant, h http.Handler) http.Handler {
+	if t.adminToken == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Dashboard page is static and sends the token along with its
+		// requests
+		if r.URL.Path == "/" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.adminToken)) != 1 {
+			http.Error(w, "Bad admin token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,113 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// AdaptiveLimiter is a per-connection Limiter whose rate is adjusted from
+// outside, for example when path to destination appears congested. All
+// traffic is charged to the next limiter as well. While rate isn't set,
+// next limiter is used alone.
+type AdaptiveLimiter struct {
+	state *adaptiveState
+	next  Limiter
+}
+
+// adaptiveState is the rate shared by AdaptiveLimiter and its copies with
+// other next limiters
+type adaptiveState struct {
+	mu     sync.Mutex
+	limit  rate.Limit
+	bucket *rate.Limiter
+}
+
+// NewAdaptiveLimiter creates AdaptiveLimiter that doesn't limit anything
+// besides 'next' until its rate is set
+func NewAdaptiveLimiter(next Limiter) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		state: &adaptiveState{limit: rate.Inf, bucket: rate.NewLimiter(rate.Inf, MaxBurstSize)},
+		next:  next,
+	}
+}
+
+// WithNext returns AdaptiveLimiter sharing rate with this one, but charging
+// traffic to another next limiter
+func (a *AdaptiveLimiter) WithNext(next Limiter) *AdaptiveLimiter {
+	return &AdaptiveLimiter{state: a.state, next: next}
+}
+
+// SetLimit sets rate of the limiter at a given moment. rate.Inf leaves
+// next limiter alone.
+func (a *AdaptiveLimiter) SetLimit(now time.Time, limit rate.Limit) {
+	s := a.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.bucket.SetLimitAt(now, limit)
+	s.bucket.SetBurstAt(now, GetGoodBurst(limit))
+}
+
+// Limit returns rate set with SetLimit
+func (a *AdaptiveLimiter) Limit() rate.Limit {
+	a.state.mu.Lock()
+	defer a.state.mu.Unlock()
+	return a.state.limit
+}
+
+// reserve reserves n bytes in bucket or returns nil if rate isn't set.
+// Bucket is enlarged to fit n bytes, since rate might have been lowered
+// after connection asked for burst size.
+func (s *adaptiveState) reserve(now time.Time, n int) *rate.Reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limit == rate.Inf {
+		return nil
+	}
+	if n > s.bucket.Burst() {
+		s.bucket.SetBurstAt(now, n)
+	}
+	return s.bucket.ReserveN(now, n)
+}
+
+func (a *AdaptiveLimiter) Burst() int {
+	res := a.next.Burst()
+	limit := a.Limit()
+	if limit == rate.Inf {
+		return res
+	}
+	if burst := GetGoodBurst(limit); burst < res {
+		res = burst
+	}
+	return res
+}
+
+func (a *AdaptiveLimiter) AllowN(now time.Time, n int) bool {
+	res := a.state.reserve(now, n)
+	if res == nil {
+		return a.next.AllowN(now, n)
+	}
+	if res.OK() && res.DelayFrom(now) == 0 && a.next.AllowN(now, n) {
+		return true
+	}
+	res.CancelAt(now)
+	return false
+}
+
+func (a *AdaptiveLimiter) Reserve(now time.Time, n int) time.Time {
+	res := a.state.reserve(now, n)
+	if res == nil {
+		return a.next.Reserve(now, n)
+	}
+	at := now.Add(res.DelayFrom(now))
+	if next := a.next.Reserve(now, n); next.After(at) {
+		at = next
+	}
+	return at
+}
+
+func (a *AdaptiveLimiter) release(now time.Time) {
+	release(a.next, now)
+}
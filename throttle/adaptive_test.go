@@ -0,0 +1,21 @@
+package throttle_test
+
+import (
+	"testing"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+func TestAdaptiveLimiterSetLimitTakesEffectAtGivenTime(t *testing.T) {
+	a := throttle.NewAdaptiveLimiter(throttle.NewLimiter(rate.Inf))
+	a.SetLimit(epoch, testLimit)
+	a.Reserve(epoch, testBurst)
+	// Bucket is still empty once rate is raised, it just refills twice as
+	// fast
+	a.SetLimit(epoch, 2*testLimit)
+	assertAt(t, "Bytes are reserved", a.Reserve(epoch, testBurst), epoch.Add(refill/2))
+	// Lifting the limit leaves only the next limiter
+	a.SetLimit(epoch, rate.Inf)
+	assertAt(t, "Bytes are reserved", a.Reserve(epoch, 10*testBurst), epoch)
+}
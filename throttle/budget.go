@@ -0,0 +1,99 @@
+package throttle
+
+import (
+	"sync"
+)
+
+// Sizes of buffers handed out by BufferBudget. Buffers are powers of two
+// between these.
+const (
+	MinBufferSize = 2 * 1024
+	MaxBufferSize = 32 * 1024
+)
+
+// BufferBudget caps total size of buffers used to copy data through
+// connections sharing it. Buffers are full-sized while less than half of
+// the budget is used and shrink down to MinBufferSize as usage approaches
+// the cap, so that many connections copy in smaller chunks rather than run
+// out of memory. Buffers are never refused: usage may exceed the cap,
+// which callers should prevent by waiting with Wait before taking on more
+// connections.
+type BufferBudget struct {
+	max int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	used int64
+	// pools hold released buffers by their sizes
+	pools map[int]*sync.Pool
+}
+
+// NewBufferBudget creates BufferBudget capping total size of buffers at
+// 'max' bytes
+func NewBufferBudget(max int64) *BufferBudget {
+	b := &BufferBudget{max: max, pools: make(map[int]*sync.Pool)}
+	b.cond = sync.NewCond(&b.mu)
+	for size := MinBufferSize; size <= MaxBufferSize; size *= 2 {
+		size := size
+		b.pools[size] = &sync.Pool{New: func() interface{} { return make([]byte, 0, size) }}
+	}
+	return b
+}
+
+// Get returns an empty buffer sized according to current usage of the
+// budget. Buffer has to be returned with Put.
+func (b *BufferBudget) Get() []byte {
+	b.mu.Lock()
+	size := b.sizeLocked()
+	b.used += int64(size)
+	b.mu.Unlock()
+	return b.pools[size].Get().([]byte)[:0]
+}
+
+// sizeLocked returns size of the next buffer
+func (b *BufferBudget) sizeLocked() int {
+	free := b.max - b.used
+	half := b.max / 2
+	if free >= half {
+		return MaxBufferSize
+	}
+	size := MaxBufferSize
+	for size > MinBufferSize && int64(size)*half > MaxBufferSize*free {
+		size /= 2
+	}
+	return size
+}
+
+// Put returns buffer taken with Get
+func (b *BufferBudget) Put(buf []byte) {
+	pool, ok := b.pools[cap(buf)]
+	if !ok {
+		panic("buffer that's put into BufferBudget wasn't taken from it")
+	}
+	b.mu.Lock()
+	b.used -= int64(cap(buf))
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	pool.Put(buf[:0]) // nolint: staticcheck
+}
+
+// Used returns total size of buffers taken and not returned yet
+func (b *BufferBudget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Max returns the cap of the budget
+func (b *BufferBudget) Max() int64 {
+	return b.max
+}
+
+// Wait blocks until usage of the budget drops below its cap
+func (b *BufferBudget) Wait() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used >= b.max {
+		b.cond.Wait()
+	}
+}
@@ -0,0 +1,62 @@
+package throttle
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// capLimiter is a per-connection Limiter that keeps a connection under its
+// own rate on top of the limiter it's subject to. All traffic is charged to
+// both, so connection can't go faster than either allows.
+type capLimiter struct {
+	cap  *rate.Limiter
+	next Limiter
+}
+
+// NewCapLimiter creates a Limiter that holds a connection limited by 'next'
+// at no more than 'limit'
+func NewCapLimiter(limit rate.Limit, next Limiter) Limiter {
+	return &capLimiter{cap: rate.NewLimiter(limit, GetGoodBurst(limit)), next: next}
+}
+
+func (c *capLimiter) Burst() int {
+	res := c.next.Burst()
+	if burst := c.cap.Burst(); burst < res {
+		res = burst
+	}
+	return res
+}
+
+func (c *capLimiter) AllowN(now time.Time, n int) bool {
+	res := c.cap.ReserveN(now, n)
+	if res.OK() && res.DelayFrom(now) == 0 && c.next.AllowN(now, n) {
+		return true
+	}
+	res.CancelAt(now)
+	return false
+}
+
+func (c *capLimiter) Reserve(now time.Time, n int) time.Time {
+	at := now.Add(c.cap.ReserveN(now, n).DelayFrom(now))
+	if next := c.next.Reserve(now, n); next.After(at) {
+		at = next
+	}
+	return at
+}
+
+func (c *capLimiter) maxRate() rate.Limit {
+	res := LimitOf(c.next)
+	if limit := c.cap.Limit(); limit < res {
+		res = limit
+	}
+	return res
+}
+
+func (c *capLimiter) refund(now time.Time, n int) {
+	refund(c.next, now, n)
+}
+
+func (c *capLimiter) release(now time.Time) {
+	release(c.next, now)
+}
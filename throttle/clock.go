@@ -0,0 +1,41 @@
+package throttle
+
+import "time"
+
+// Clock is a source of time for limited connections. It allows tests to run
+// throttled transfers without actually waiting.
+type Clock interface {
+	// Now returns current time
+	Now() time.Time
+	// NewTimer creates a timer firing once given duration elapses
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer created by Clock
+type Timer interface {
+	// C returns a channel current time is sent to when timer fires
+	C() <-chan time.Time
+	// Stop prevents timer from firing
+	Stop() bool
+}
+
+// SystemClock is a Clock backed by the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
@@ -0,0 +1,99 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// floorLimiter is a per-connection Limiter guaranteeing a connection a
+// minimum rate under a shared limiter, so that greedy connections can't
+// starve it. Whenever the shared limiter would make connection wait longer
+// than its floor rate allows, connection goes ahead at the floor rate.
+//
+// All traffic is charged to the shared limiter, so bytes sent thanks to
+// the floor are paid back by delaying other connections and the shared
+// limit holds over time as long as it's no less than the sum of floors of
+// its connections.
+type floorLimiter struct {
+	floor rate.Limit
+	// slack is how far ahead of the floor schedule connection may get,
+	// which is the time floor takes to pay for its burst
+	slack time.Duration
+	next  Limiter
+
+	mu sync.Mutex
+	// paid is the moment bytes sent thanks to the floor so far are paid
+	// for at the floor rate
+	paid time.Time
+}
+
+// NewFloorLimiter creates a Limiter guaranteeing 'floor' rate to a
+// connection limited by 'next'. 'batch' is the number of bytes connection
+// reserves at once if it reserves in batches.
+func NewFloorLimiter(floor rate.Limit, batch int, next Limiter) Limiter {
+	// Floor saves up no more than it takes to keep its rate precise, or a
+	// whole batch, so that a starved batch doesn't wait for itself to be
+	// paid for in full
+	burst := GetGoodBurst(floor)
+	if batch > burst {
+		burst = batch
+	}
+	return &floorLimiter{floor: floor, slack: floorDuration(floor, burst), next: next}
+}
+
+// floorDuration returns the time it takes to pay for n bytes at a given rate
+func floorDuration(l rate.Limit, n int) time.Duration {
+	return time.Duration(float64(n) / float64(l) * float64(time.Second))
+}
+
+func (f *floorLimiter) Burst() int {
+	return f.next.Burst()
+}
+
+// AllowN doesn't consult floor, since connection that can't go right away
+// isn't starved yet
+func (f *floorLimiter) AllowN(now time.Time, n int) bool {
+	return f.next.AllowN(now, n)
+}
+
+func (f *floorLimiter) Reserve(now time.Time, n int) time.Time {
+	at := f.next.Reserve(now, n)
+	// Connection is starved only if shared limiter makes it wait longer
+	// than floor rate takes to pay for the bytes. Shorter waits are just
+	// pacing of the shared limit, which floor is kept out of.
+	cost := floorDuration(f.floor, n)
+	if !at.After(now.Add(cost)) {
+		return at
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	paid := f.paid
+	if paid.Before(now) {
+		paid = now
+	}
+	paid = paid.Add(cost)
+	floorAt := paid.Add(-f.slack)
+	if floorAt.Before(now) {
+		floorAt = now
+	}
+	if !floorAt.Before(at) {
+		// Connection isn't starved, so floor is kept for when it is
+		return at
+	}
+	f.paid = paid
+	return floorAt
+}
+
+func (f *floorLimiter) maxRate() rate.Limit {
+	return LimitOf(f.next)
+}
+
+func (f *floorLimiter) refund(now time.Time, n int) {
+	refund(f.next, now, n)
+}
+
+func (f *floorLimiter) release(now time.Time) {
+	release(f.next, now)
+}
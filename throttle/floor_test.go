@@ -0,0 +1,58 @@
+package throttle_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+)
+
+// assertAt checks that bytes were reserved for a given moment
+func assertAt(t *testing.T, what string, at, expected time.Time) {
+	t.Helper()
+	if d := at.Sub(expected); d < -time.Millisecond || d > time.Millisecond {
+		t.Fatalf("%s at %v, expected %v", what, at.Sub(epoch), expected.Sub(epoch))
+	}
+}
+
+// saturate makes greedy connections take a shared limiter for a given time
+// since epoch
+func saturate(shared throttle.Limiter, d time.Duration) {
+	for shared.Reserve(epoch, shared.Burst()).Before(epoch.Add(d)) {
+	}
+}
+
+func TestFloorLimiterFitsBatch(t *testing.T) {
+	const floor = 1024 * 1024
+	shared := throttle.NewHighRateLimiter(100 * 1024 * 1024)
+	saturate(shared, 450*time.Millisecond)
+	f := throttle.NewFloorLimiter(floor, highRateBatch, shared)
+	assertAt(t, "First batch is reserved", f.Reserve(epoch, highRateBatch), epoch)
+	assertAt(t, "Second batch is reserved", f.Reserve(epoch, highRateBatch),
+		epoch.Add(time.Duration(highRateBatch*float64(time.Second)/floor)))
+}
+
+func TestFloorLimiterKeepsOutOfShortWaits(t *testing.T) {
+	const limit, floor = 100 * 1024, 8 * 1024
+	shared := throttle.NewLimiter(limit)
+	shared.Reserve(epoch, shared.Burst())
+	f := throttle.NewFloorLimiter(floor, 0, shared)
+	// Waiting for a hundredth of a second isn't starvation
+	assertAt(t, "Bytes are reserved", f.Reserve(epoch, 1024),
+		epoch.Add(time.Duration(1024*float64(time.Second)/limit)))
+	// So floor still has its burst once connection gets starved
+	saturate(shared, time.Second)
+	assertAt(t, "Starved bytes are reserved", f.Reserve(epoch, throttle.GetGoodBurst(floor)), epoch)
+}
+
+func TestFloorLimiterDoesNotSaveUp(t *testing.T) {
+	const limit, floor = 100 * 1024, 8 * 1024
+	shared := throttle.NewLimiter(limit)
+	saturate(shared, 10*time.Second)
+	f := throttle.NewFloorLimiter(floor, 0, shared)
+	// Only floor burst is there however long connection has been idle
+	later := epoch.Add(time.Second)
+	const n = 4096
+	assertAt(t, "Starved bytes are reserved", f.Reserve(later, n),
+		later.Add(time.Duration(float64(n-throttle.GetGoodBurst(floor))*float64(time.Second)/floor)))
+}
@@ -0,0 +1,88 @@
+package throttle_test
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/anton-dessiatov/throttlesocks/throttletest"
+)
+
+// epoch is the moment manual clocks of tests start at
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// discardConn is a net.Conn that accepts and drops everything written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (discardConn) Close() error                { return nil }
+
+func (discardConn) SetDeadline(time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+// writeAll writes 'size' bytes to every connection in 'chunk'-sized writes
+// concurrently. Clock is advanced to the next timer whenever all writers
+// wait for their limiters. It returns the time writing took by the clock.
+func writeAll(clock *throttletest.ManualClock, conns []*throttle.LimitedConnection, size int64, chunk int) time.Duration {
+	start := clock.Now()
+	active := int64(len(conns))
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer atomic.AddInt64(&active, -1)
+			buf := make([]byte, chunk)
+			for written := int64(0); written < size; written += int64(chunk) {
+				if _, err := c.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return clock.Now().Sub(start)
+		default:
+		}
+		if n := atomic.LoadInt64(&active); n > 0 && int64(clock.Pending()) >= n {
+			clock.AdvanceToNext()
+		} else {
+			runtime.Gosched()
+		}
+	}
+}
+
+// waitPending waits until clock has at least n pending timers, that is
+// until n transfers block on their limiters
+func waitPending(clock *throttletest.ManualClock, n int) {
+	for clock.Pending() < n {
+		runtime.Gosched()
+	}
+}
+
+// zeroConn is a net.Conn that reads zeros and discards everything written
+// to it
+type zeroConn struct {
+	discardConn
+}
+
+func (zeroConn) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
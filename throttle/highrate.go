@@ -0,0 +1,109 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// MaxHighRateBurstSize defines maximum size of a burst of limiters created
+// by NewHighRateLimiter
+const MaxHighRateBurstSize = 16 * 1024 * 1024
+
+// GetHighRateBurst is like GetGoodBurst, but lets burst grow up to
+// MaxHighRateBurstSize, so that limits above roughly 1.3Gbps still get 20
+// bursts per second instead of waits too short for timers to keep up with
+func GetHighRateBurst(l rate.Limit) int {
+	if l == rate.Limit(0) || l == rate.Inf {
+		return MaxBurstSize
+	}
+	burstSize := int64(l) / 20
+	if burstSize <= MaxBurstSize {
+		return GetGoodBurst(l)
+	}
+	if burstSize > MaxHighRateBurstSize {
+		burstSize = MaxHighRateBurstSize
+	}
+	return int(burstSize)
+}
+
+// NewHighRateLimiter creates token bucket Limiter for a multi-gigabit
+// bandwidth limit. Its bursts are sized by GetHighRateBurst. Its limit may
+// be changed with SetLimit, but burst is kept.
+func NewHighRateLimiter(limit rate.Limit) Limiter {
+	return tokenBucket{rate.NewLimiter(limit, GetHighRateBurst(limit))}
+}
+
+// batchLimiter is a per-connection Limiter that reserves bytes from the
+// next limiter in batches and hands them out to reads and writes of the
+// connection until they run out. Shared limiters of fast connections are
+// locked once per batch rather than once per read or write. Bytes left
+// unused once connection is closed are refunded to the next limiter.
+type batchLimiter struct {
+	next  Limiter
+	batch int
+
+	mu sync.Mutex
+	// credit is the number of bytes reserved, but not handed out yet. They
+	// may be transferred at creditAt.
+	credit   int
+	creditAt time.Time
+}
+
+// NewBatchLimiter creates Limiter reserving bytes from 'next' in batches
+// of up to 'batch' bytes (limited by burst of 'next')
+func NewBatchLimiter(next Limiter, batch int) Limiter {
+	return &batchLimiter{next: next, batch: batch}
+}
+
+func (b *batchLimiter) maxRate() rate.Limit {
+	return LimitOf(b.next)
+}
+
+func (b *batchLimiter) Burst() int {
+	return b.next.Burst()
+}
+
+func (b *batchLimiter) AllowN(now time.Time, n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.credit >= n && !b.creditAt.After(now) {
+		b.credit -= n
+		return true
+	}
+	return b.next.AllowN(now, n)
+}
+
+func (b *batchLimiter) Reserve(now time.Time, n int) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.credit >= n {
+		b.credit -= n
+		if b.creditAt.After(now) {
+			return b.creditAt
+		}
+		return now
+	}
+	// Credit left is used up along with the new batch
+	size := b.batch
+	if burst := b.next.Burst(); size > burst {
+		size = burst
+	}
+	if need := n - b.credit; size < need {
+		size = need
+	}
+	b.creditAt = b.next.Reserve(now, size)
+	b.credit += size - n
+	return b.creditAt
+}
+
+// release refunds credit left to the next limiter and releases it
+func (b *batchLimiter) release(now time.Time) {
+	b.mu.Lock()
+	credit := b.credit
+	b.credit = 0
+	b.mu.Unlock()
+	refund(b.next, now, credit)
+	release(b.next, now)
+}
@@ -0,0 +1,71 @@
+package throttle_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/anton-dessiatov/throttlesocks/throttletest"
+)
+
+// highRateBatch matches batch size of connections in high-rate mode
+const highRateBatch = 256 * 1024
+
+// benchmarkHighRate runs connections sharing a high-rate limiter through a
+// batch limiter each for two seconds of simulated time and checks that
+// they get the limit between them
+func benchmarkHighRate(b *testing.B, limit string) {
+	l, err := throttle.ParseRate(limit)
+	if err != nil {
+		b.Fatal(err)
+	}
+	const conns = 8
+	const chunk = 32 * 1024
+	perConn := int64(2*float64(l)) / conns
+	b.SetBytes(perConn * conns)
+	var achieved float64
+	for i := 0; i < b.N; i++ {
+		shared := throttle.NewHighRateLimiter(l)
+		clock := throttletest.NewManualClock(epoch)
+		cs := make([]*throttle.LimitedConnection, conns)
+		for j := range cs {
+			cs[j] = throttle.NewLimitedConnectionWithClock(discardConn{},
+				throttle.NewBatchLimiter(shared, highRateBatch), clock)
+		}
+		elapsed := writeAll(clock, cs, perConn, chunk)
+		achieved = float64(perConn*conns) / elapsed.Seconds()
+	}
+	b.ReportMetric(achieved*8/1e9, "Gbps")
+	// Bucket starts full, which is worth a fraction of a percent over two
+	// seconds
+	if ratio := achieved / float64(l); math.Abs(ratio-1) > 0.02 {
+		b.Fatalf("Achieved %.3f Gbps, expected %s", achieved*8/1e9, limit)
+	}
+}
+
+func BenchmarkHighRate5Gbps(b *testing.B) {
+	benchmarkHighRate(b, "5Gbps")
+}
+
+func BenchmarkHighRate10Gbps(b *testing.B) {
+	benchmarkHighRate(b, "10Gbps")
+}
+
+func TestBatchLimiterRefundsCreditOnClose(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	shared := throttle.NewHighRateLimiter(100 * 1024 * 1024)
+	conn := throttle.NewLimitedConnectionWithClock(discardConn{},
+		throttle.NewBatchLimiter(shared, highRateBatch), clock)
+	if _, err := conn.Write(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	// Batch holds the rest of 256KB reserved from the full bucket
+	left := shared.Burst() - 1024
+	if shared.AllowN(clock.Now(), left) {
+		t.Fatalf("Batch hasn't been reserved from shared limiter")
+	}
+	conn.Close()
+	if !shared.AllowN(clock.Now(), left) {
+		t.Fatalf("Credit left in batch hasn't been refunded on close")
+	}
+}
@@ -0,0 +1,91 @@
+package throttle
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// borrowingLimiter is a Limiter for a traffic class that has a guaranteed
+// rate and may borrow bandwidth unused by other classes of the same link up
+// to a ceiling, much like HTB classes of Linux traffic control.
+//
+// All traffic of the class is charged to the link, so link rate should be
+// no less than the sum of guaranteed rates of its classes for guarantees to
+// hold.
+type borrowingLimiter struct {
+	assured *rate.Limiter
+	ceil    *rate.Limiter
+	link    Limiter
+}
+
+// NewClassLimiter creates a Limiter for a traffic class. If 'ceil' is zero,
+// class is limited by its rate only. Otherwise it may borrow from 'link'.
+func NewClassLimiter(limit rate.Limit, ceil rate.Limit, link Limiter) Limiter {
+	if ceil == 0 || ceil == limit {
+		return NewLimiter(limit)
+	}
+	return &borrowingLimiter{
+		assured: rate.NewLimiter(limit, GetGoodBurst(limit)),
+		ceil:    rate.NewLimiter(ceil, GetGoodBurst(ceil)),
+		link:    link,
+	}
+}
+
+func (b *borrowingLimiter) Burst() int {
+	res := b.assured.Burst()
+	if burst := b.ceil.Burst(); burst < res {
+		res = burst
+	}
+	if burst := b.link.Burst(); burst < res {
+		res = burst
+	}
+	return res
+}
+
+func (b *borrowingLimiter) maxRate() rate.Limit {
+	res := LimitOf(b.link)
+	if limit := b.ceil.Limit(); limit < res {
+		res = limit
+	}
+	return res
+}
+
+func (b *borrowingLimiter) AllowN(now time.Time, n int) bool {
+	// Guaranteed rate goes first
+	if b.assured.AllowN(now, n) {
+		b.ceil.ReserveN(now, n)
+		b.link.Reserve(now, n)
+		return true
+	}
+	// Then try borrowing from the link without exceeding the ceiling
+	r := b.ceil.ReserveN(now, n)
+	if r.OK() && r.DelayFrom(now) == 0 && b.link.AllowN(now, n) {
+		return true
+	}
+	r.CancelAt(now)
+	return false
+}
+
+func (b *borrowingLimiter) Reserve(now time.Time, n int) time.Time {
+	if b.AllowN(now, n) {
+		return now
+	}
+	// Nothing to borrow right now, so wait for guaranteed rate
+	at := now.Add(b.assured.ReserveN(now, n).DelayFrom(now))
+	b.ceil.ReserveN(now, n)
+	b.link.Reserve(now, n)
+	return at
+}
+
+// refund returns bytes to the ceiling and the link. Guaranteed rate isn't
+// refunded, since it's unknown whether they were charged to it.
+func (b *borrowingLimiter) refund(now time.Time, n int) {
+	tokenBucket{b.ceil}.refund(now, n)
+	refund(b.link, now, n)
+}
+
+// TokensAt returns bucket level of guaranteed rate
+func (b *borrowingLimiter) TokensAt(t time.Time) float64 {
+	return b.assured.TokensAt(t)
+}
@@ -0,0 +1,646 @@
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// LimitedConnection is a wrapper around net.Conn that limits the rate of its
+// Read and Write operations based on given rate.
+type LimitedConnection struct {
+	// Counters are updated atomically. They go first to keep them 64-bit
+	// aligned on 32-bit platforms.
+	bytesRead    int64
+	bytesWritten int64
+	waitTime     int64
+	// maxSegment limits size of every transfer to and from the inner
+	// connection if non-zero
+	maxSegment int64
+
+	inner   net.Conn
+	clock   Clock
+	created time.Time
+
+	readMeter  rateMeter
+	writeMeter rateMeter
+
+	limiterMu sync.Mutex
+	limiter   Limiter
+	tracer    func(Trace)
+	// monitor is set if transfers are only accounted, but never delayed
+	monitor bool
+	// budget provides buffers for ReadFrom and WriteTo if set
+	budget         *BufferBudget
+	readNotBefore  time.Time
+	writeNotBefore time.Time
+	// writePrepaid is the number of bytes writes have paid for in advance
+	writePrepaid int
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	close         chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewLimitedConnection creates a LimitedConnection from net.Conn and a bytes-per-second value
+func NewLimitedConnection(inner net.Conn, limiter Limiter) *LimitedConnection {
+	return NewLimitedConnectionWithClock(inner, limiter, SystemClock)
+}
+
+// NewLimitedConnectionWithClock creates a LimitedConnection that takes time
+// from a given clock. Deadlines are compared against that clock as well.
+func NewLimitedConnectionWithClock(inner net.Conn, limiter Limiter, clock Clock) *LimitedConnection {
+	return &LimitedConnection{
+		inner:   inner,
+		clock:   clock,
+		created: clock.Now(),
+		limiter: limiter,
+		close:   make(chan struct{}),
+	}
+}
+
+// ConnectionStats is a point-in-time snapshot of LimitedConnection counters
+type ConnectionStats struct {
+	// BytesRead is the number of bytes read from the inner connection
+	BytesRead int64
+	// BytesWritten is the number of bytes written to the inner connection
+	BytesWritten int64
+	// WaitTime is the total time Read and Write spent waiting for the limiter
+	WaitTime time.Duration
+	// Created is the time the connection was wrapped
+	Created time.Time
+	// ReadRate is the smoothed current read rate in bytes per second
+	ReadRate float64
+	// WriteRate is the smoothed current write rate in bytes per second
+	WriteRate float64
+}
+
+// Stats returns current connection statistics. It is safe to call
+// concurrently with Read and Write.
+func (c *LimitedConnection) Stats() ConnectionStats {
+	now := c.clock.Now()
+	return ConnectionStats{
+		BytesRead:    atomic.LoadInt64(&c.bytesRead),
+		BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+		WaitTime:     time.Duration(atomic.LoadInt64(&c.waitTime)),
+		Created:      c.created,
+		ReadRate:     c.readMeter.Rate(now),
+		WriteRate:    c.writeMeter.Rate(now),
+	}
+}
+
+// LocalAddr is an implementation of net.Conn.LocalAddr
+func (c *LimitedConnection) LocalAddr() net.Addr {
+	return c.inner.LocalAddr()
+}
+
+// RemoteAddr is an implementation of net.Conn.RemoteAddr
+func (c *LimitedConnection) RemoteAddr() net.Addr {
+	return c.inner.RemoteAddr()
+}
+
+// Read is an implementation of net.Conn.Read
+func (c *LimitedConnection) Read(b []byte) (read int, err error) {
+	return c.rateLimitLoop(&c.readNotBefore, &c.readDeadline, &c.bytesRead,
+		&c.readMeter, false, func(n int) (int, error) { return c.inner.Read(b[:n]) }, len(b))
+}
+
+// Write is an implementation of net.Conn.Write. Unlike Read it doesn't
+// return until whole 'b' is written or an error occurs, since short writes
+// are not allowed by io.Writer.
+func (c *LimitedConnection) Write(b []byte) (written int, err error) {
+	for {
+		var n int
+		rest := b[written:]
+		n, err = c.rateLimitLoop(&c.writeNotBefore, &c.writeDeadline,
+			&c.bytesWritten, &c.writeMeter, true,
+			func(n int) (int, error) { return c.inner.Write(rest[:n]) }, len(rest))
+		written += n
+		if err != nil || written == len(b) {
+			return
+		}
+	}
+}
+
+// ReadFrom is an implementation of io.ReaderFrom. If the inner connection
+// implements io.ReaderFrom too, data is handed to it in burst-sized chunks
+// so that it may copy without an intermediate buffer (for example, TCP
+// connections splice data from other TCP connections). If connection has
+// a buffer budget, data is always copied through a buffer taken from it.
+func (c *LimitedConnection) ReadFrom(r io.Reader) (total int64, err error) {
+	if budget := c.getBudget(); budget != nil {
+		return copyBudgeted(writerOnly{c}, r, budget)
+	}
+	rf, ok := c.inner.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{c}, r)
+	}
+	for {
+		var n int
+		n, err = c.rateLimitLoop(&c.writeNotBefore, &c.writeDeadline,
+			&c.bytesWritten, &c.writeMeter, true, func(n int) (int, error) {
+				copied, err := rf.ReadFrom(io.LimitReader(r, int64(n)))
+				if err == nil && copied < int64(n) {
+					err = io.EOF
+				}
+				return int(copied), err
+			}, maxChunk)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WriteTo is an implementation of io.WriterTo. If 'w' implements
+// io.ReaderFrom, data is handed to it from the inner connection in
+// burst-sized chunks so that it may copy without an intermediate buffer. If
+// connection has a buffer budget, data is always copied through a buffer
+// taken from it.
+func (c *LimitedConnection) WriteTo(w io.Writer) (total int64, err error) {
+	if budget := c.getBudget(); budget != nil {
+		return copyBudgeted(w, readerOnly{c}, budget)
+	}
+	rf, ok := w.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(w, readerOnly{c})
+	}
+	for {
+		var n int
+		n, err = c.rateLimitLoop(&c.readNotBefore, &c.readDeadline,
+			&c.bytesRead, &c.readMeter, false, func(n int) (int, error) {
+				copied, err := rf.ReadFrom(io.LimitReader(c.inner, int64(n)))
+				if err == nil && copied < int64(n) {
+					err = io.EOF
+				}
+				return int(copied), err
+			}, maxChunk)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// maxChunk is the size of data ReadFrom and WriteTo ask for. Chunks are
+// further limited by limiter burst.
+const maxChunk = math.MaxInt32
+
+// copyBudgeted copies from src to dst through a buffer taken from budget.
+// Neither io.WriterTo of src nor io.ReaderFrom of dst is used, since they
+// would allocate buffers of their own.
+func copyBudgeted(dst io.Writer, src io.Reader, budget *BufferBudget) (int64, error) {
+	buf := budget.Get()
+	defer budget.Put(buf)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf[:cap(buf)])
+}
+
+// writerOnly hides io.ReaderFrom of a writer from io.Copy
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly hides io.WriterTo of a reader from io.Copy
+type readerOnly struct {
+	io.Reader
+}
+
+// The idea is that we read in chunks equal to max burst allowed by multilimiter
+// After reading we attempt to reserve time slot for a read chunk. If we succeed
+// we go on. If not, we check what happens before - operation deadline or wait
+// time. If that's wait time then simply wait and repeat. If it's a deadline
+// then set 'not before' timestamp and wait for it upon next invocation.
+// Every transferred byte is added to 'transferred' counter and 'meter'.
+// 'write' is set for writes to the inner connection. 'innerAct' transfers
+// no more than given number of bytes, 'size' is the number of bytes caller
+// wants to transfer.
+//
+// Paying for a chunk after transferring it lets connection get a chunk ahead
+// of its limiter, which is negligible as long as a chunk is paid for within
+// a fraction of a second. At rates so low that limiter burst is a single
+// byte, a byte may take seconds to pay for, so writes are scheduled instead:
+// chunk is reserved first and transferred once limiter allows it. Reads
+// aren't scheduled since they would hold limiter while waiting for data,
+// and their data is handed to caller only once it's paid for anyway.
+func (c *LimitedConnection) rateLimitLoop(notBefore *time.Time,
+	deadline *time.Time, transferred *int64, meter *rateMeter, write bool,
+	innerAct func(n int) (int, error), size int) (cntr int, err error) {
+	if size == 0 {
+		return innerAct(0)
+	}
+
+	now := c.clock.Now()
+	var until time.Time
+
+	if now.Before(*notBefore) {
+		until = *notBefore
+		if !deadline.IsZero() && deadline.Before(until) {
+			until = *deadline
+		}
+	}
+
+	if !until.IsZero() {
+		if c.waitUntil(until) {
+			err = io.ErrClosedPipe
+			return
+		}
+	}
+
+	limiter, monitor := c.getLimiter()
+	burst := MaxBurstSize
+	if !monitor {
+		burst = limiter.Burst()
+	}
+	schedule := write && !monitor && burst <= MinBurstSize
+	if !schedule && write {
+		// Limiter got faster, so bytes paid for in advance are just spent
+		c.writePrepaid = 0
+	}
+	var n int
+	if burst > size {
+		burst = size
+	}
+	if seg := int(atomic.LoadInt64(&c.maxSegment)); seg > 0 && burst > seg {
+		burst = seg
+	}
+	if schedule {
+		if c.writePrepaid == 0 {
+			now = c.clock.Now()
+			act := limiter.Reserve(now, burst)
+			c.writePrepaid = burst
+			c.trace(limiter, now, write, burst, act)
+			if now.Before(act) {
+				if !deadline.IsZero() && deadline.Before(act) {
+					*notBefore = act
+					err = timeoutError{}
+					return
+				}
+				if c.waitUntil(act) {
+					err = io.ErrClosedPipe
+					return
+				}
+			}
+		}
+		if burst > c.writePrepaid {
+			burst = c.writePrepaid
+		}
+	}
+	n, err = innerAct(burst)
+	if n == 0 {
+		return
+	}
+
+	cntr += n
+	atomic.AddInt64(transferred, int64(n))
+	until = time.Time{}
+
+	now = c.clock.Now()
+	meter.add(now, n)
+	if monitor {
+		return
+	}
+	if schedule {
+		c.writePrepaid -= n
+		return
+	}
+	// Reserving with the same limiter that has given burst size guarantees
+	// that reservation succeeds even if limiter got replaced meanwhile
+	act := limiter.Reserve(now, n)
+	c.trace(limiter, now, write, n, act)
+	if now.Before(act) {
+		if !deadline.IsZero() && deadline.Before(act) {
+			*notBefore = act
+			err = timeoutError{}
+			return
+		}
+		until = act
+	}
+	if !until.IsZero() {
+		if c.waitUntil(act) {
+			err = io.ErrClosedPipe
+			return
+		}
+	}
+	return
+}
+
+// trace reports reservation of n bytes that may be transferred at 'act' to
+// tracer of the connection if it has one
+func (c *LimitedConnection) trace(limiter Limiter, now time.Time, write bool, n int, act time.Time) {
+	tracer := c.getTracer()
+	if tracer == nil {
+		return
+	}
+	t := Trace{
+		Time:  now,
+		Write: write,
+		Bytes: n,
+		Delay: act.Sub(now),
+	}
+	if tc, ok := limiter.(tokenCounter); ok {
+		t.Tokens, t.HasTokens = tc.TokensAt(now), true
+	}
+	tracer(t)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "deadline exceeded" }
+
+func (timeoutError) Timeout() bool { return true }
+
+func (timeoutError) Temporary() bool { return true }
+
+// SetDeadline is an implementation of net.Conn.SetDeadline
+func (c *LimitedConnection) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline is an implementation of net.Conn.SetReadDeadline
+func (c *LimitedConnection) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.inner.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is an implementation of net.Conn.SetWriteDeadline
+func (c *LimitedConnection) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+	return c.inner.SetWriteDeadline(t)
+}
+
+// closeWriter is implemented by connections that support half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down writing side of connection if it supports that
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("Half-close is not supported by %T", c)
+}
+
+// CloseWrite shuts down writing side of the underlying connection
+func (c *LimitedConnection) CloseWrite() error {
+	return closeWrite(c.inner)
+}
+
+// SyscallConn is an implementation of syscall.Conn. It gives access to the
+// underlying socket of the inner connection bypassing the limiter, so it
+// fails unless the inner connection implements syscall.Conn.
+func (c *LimitedConnection) SyscallConn() (syscall.RawConn, error) {
+	return syscallConn(c.inner)
+}
+
+func syscallConn(inner interface{}) (syscall.RawConn, error) {
+	if sc, ok := inner.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, fmt.Errorf("%T doesn't implement syscall.Conn", inner)
+}
+
+// Close is an implementation of net.Conn.Close. It is safe to call Close
+// more than once.
+func (c *LimitedConnection) Close() error {
+	var res error
+	c.closeOnce.Do(func() {
+		close(c.close)
+		res = c.inner.Close()
+		limiter, _ := c.getLimiter()
+		release(limiter, c.clock.Now())
+	})
+	return res
+}
+
+// SetLimiter replaces limiter used by the connection. Bytes reserved in
+// advance by the previous limiter are released. It is safe to call
+// concurrently with Read and Write.
+func (c *LimitedConnection) SetLimiter(limiter Limiter) {
+	c.limiterMu.Lock()
+	prev := c.limiter
+	c.limiter = limiter
+	c.limiterMu.Unlock()
+	release(prev, c.clock.Now())
+}
+
+// SetMaxSegment limits size of every read from and write to the inner
+// connection regardless of limiter burst, which emulates paths with small
+// MTU. Zero removes the limit. It is safe to call concurrently with Read
+// and Write.
+func (c *LimitedConnection) SetMaxSegment(n int) {
+	atomic.StoreInt64(&c.maxSegment, int64(n))
+}
+
+// SetTracer sets function called for every reservation the connection
+// makes. Nil disables tracing. It is safe to call concurrently with Read and
+// Write.
+func (c *LimitedConnection) SetTracer(tracer func(Trace)) {
+	c.limiterMu.Lock()
+	c.tracer = tracer
+	c.limiterMu.Unlock()
+}
+
+func (c *LimitedConnection) getTracer() func(Trace) {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+	return c.tracer
+}
+
+// SetMonitorOnly makes connection count bytes and rates without ever
+// delaying transfers if 'monitor' is set. Limiter is not consulted at all
+// meanwhile. It is safe to call concurrently with Read and Write.
+func (c *LimitedConnection) SetMonitorOnly(monitor bool) {
+	c.limiterMu.Lock()
+	c.monitor = monitor
+	c.limiterMu.Unlock()
+}
+
+// SetBufferBudget makes ReadFrom and WriteTo copy through buffers taken
+// from a given budget. Nil lets them copy the way they see fit. It is safe
+// to call concurrently with Read and Write.
+func (c *LimitedConnection) SetBufferBudget(budget *BufferBudget) {
+	c.limiterMu.Lock()
+	c.budget = budget
+	c.limiterMu.Unlock()
+}
+
+func (c *LimitedConnection) getBudget() *BufferBudget {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+	return c.budget
+}
+
+func (c *LimitedConnection) getLimiter() (Limiter, bool) {
+	c.limiterMu.Lock()
+	defer c.limiterMu.Unlock()
+	return c.limiter, c.monitor
+}
+
+// Done returns a channel that is closed when the connection gets closed
+func (c *LimitedConnection) Done() <-chan struct{} {
+	return c.close
+}
+
+// Waits until given time or until connection is closed. Returns
+// true if connection was closed and false if time has elapsed
+// or if wait was aborted by closing or sending on 'abortWait'. Time spent
+// waiting is accounted in connection stats.
+func (c *LimitedConnection) waitUntil(t time.Time) bool {
+	start := c.clock.Now()
+	defer func() {
+		atomic.AddInt64(&c.waitTime, int64(c.clock.Now().Sub(start)))
+	}()
+	timer := c.clock.NewTimer(t.Sub(start))
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return false
+	case <-c.close:
+		return true
+	}
+}
+
+// MinBurstSize defines minimum size for an limiter burst
+const MinBurstSize = 1
+
+// MaxBurstSize defines maximum size for a limiter burst
+const MaxBurstSize = 64 * 1024
+
+// Limiter decides when bytes may be transferred
+type Limiter interface {
+	// Burst returns maximum number of bytes that may be reserved at once
+	Burst() int
+	// AllowN reserves n bytes and returns true if they may be transferred
+	// at 'now'. Otherwise it reserves nothing and returns false.
+	AllowN(now time.Time, n int) bool
+	// Reserve reserves n bytes and returns the moment they may be
+	// transferred
+	Reserve(now time.Time, n int) time.Time
+}
+
+// tokenBucket is a Limiter backed by rate.Limiter
+type tokenBucket struct {
+	*rate.Limiter
+}
+
+func (b tokenBucket) Reserve(now time.Time, n int) time.Time {
+	return now.Add(b.ReserveN(now, n).DelayFrom(now))
+}
+
+// refund puts n tokens back into the bucket. Reserving a negative number of
+// tokens adds them, and bucket level is capped at burst once time advances.
+func (b tokenBucket) refund(now time.Time, n int) {
+	if b.Limit() == 0 {
+		// Burst of a zero-limit bucket is its only budget, so it's not
+		// refundable
+		return
+	}
+	b.ReserveN(now, -n)
+}
+
+// refunder is implemented by shared limiters able to take back bytes that
+// were reserved, but will never be transferred
+type refunder interface {
+	refund(now time.Time, n int)
+}
+
+// refund returns n bytes to l if it supports that
+func refund(l Limiter, now time.Time, n int) {
+	if r, ok := l.(refunder); ok && n > 0 {
+		r.refund(now, n)
+	}
+}
+
+// releaser is implemented by per-connection limiters that hold bytes
+// reserved in advance. LimitedConnection releases its limiter once it's
+// closed or replaced, so that held bytes are returned to shared limiters.
+type releaser interface {
+	release(now time.Time)
+}
+
+// release releases l if it holds anything
+func release(l Limiter, now time.Time) {
+	if r, ok := l.(releaser); ok {
+		r.release(now)
+	}
+}
+
+// maxRater is implemented by limiters able to tell the rate connection
+// limited by them gets at most
+type maxRater interface {
+	maxRate() rate.Limit
+}
+
+// LimitOf returns the rate a connection limited by l gets at most. It's
+// rate.Inf if l doesn't limit rate or can't tell.
+func LimitOf(l Limiter) rate.Limit {
+	if m, ok := l.(maxRater); ok {
+		return m.maxRate()
+	}
+	return rate.Inf
+}
+
+func (b tokenBucket) maxRate() rate.Limit {
+	return b.Limit()
+}
+
+// NewLimiter creates token bucket Limiter for a given bandwidth limit
+func NewLimiter(limit rate.Limit) Limiter {
+	return tokenBucket{rate.NewLimiter(limit, GetGoodBurst(limit))}
+}
+
+// SetLimit changes limit of a Limiter created by NewLimiter at a given
+// moment. Burst is only ever raised, so that reservations of connections
+// that have already asked for burst size still succeed. Other limiters
+// can't be changed.
+func SetLimit(l Limiter, now time.Time, limit rate.Limit) error {
+	b, ok := l.(tokenBucket)
+	if !ok {
+		return fmt.Errorf("Limit of %T can't be changed", l)
+	}
+	b.SetLimitAt(now, limit)
+	if burst := GetGoodBurst(limit); burst > b.Burst() {
+		b.SetBurstAt(now, burst)
+	}
+	return nil
+}
+
+// GetGoodBurst returns burst size that allows to precisely limit rate
+// Returned burst size is no bigger than MaxBurstSize and no less than
+// MinBurstSize. Below 40 bytes per second burst is a single byte, which
+// takes longer than a twentieth of a second to pay for, so LimitedConnection
+// schedules writes of such limiters ahead instead of paying afterwards.
+// Fractions of bytes are accounted by rate.Limiter itself.
+func GetGoodBurst(l rate.Limit) int {
+	if l == rate.Limit(0) || l == rate.Inf {
+		return MaxBurstSize
+	}
+	// We aim for 20 bursts per second to get good precision. Decrease this
+	// value to get better performance, but less precision.
+	burstSize := int64(l) / 20
+	if burstSize < MinBurstSize {
+		burstSize = MinBurstSize
+	} else if burstSize > MaxBurstSize {
+		burstSize = MaxBurstSize
+	}
+	return int(burstSize)
+}
@@ -0,0 +1,168 @@
+package throttle_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/anton-dessiatov/throttlesocks/throttletest"
+)
+
+// testLimit is the rate of limiters in tests. Its burst is 1KB, which takes
+// 50ms to refill.
+const (
+	testLimit = 20 * 1024
+	testBurst = 1024
+	refill    = 50 * time.Millisecond
+)
+
+// waitDone fails the test unless done is closed soon. Clock doesn't move by
+// itself, so anything taking longer means transfer is stuck.
+func waitDone(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transfer hasn't completed after clock advanced past its delay")
+	}
+}
+
+// assertBlocked fails the test if done is closed
+func assertBlocked(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-done:
+		t.Fatal("Transfer has completed before its delay passed")
+	default:
+	}
+}
+
+func TestLimitedConnectionWriteWaitsForLimiter(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	conn := throttle.NewLimitedConnectionWithClock(discardConn{},
+		throttle.NewLimiter(testLimit), clock)
+	// First burst comes from the full bucket, the second one is paid for
+	// by waiting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := conn.Write(make([]byte, 2*testBurst)); err != nil {
+			t.Error(err)
+		}
+	}()
+	waitPending(clock, 1)
+	clock.Advance(refill - time.Millisecond)
+	assertBlocked(t, done)
+	clock.Advance(time.Millisecond)
+	waitDone(t, done)
+	if stats := conn.Stats(); stats.BytesWritten != 2*testBurst {
+		t.Fatalf("Written %d bytes, expected %d", stats.BytesWritten, 2*testBurst)
+	}
+}
+
+func TestLimitedConnectionReadWaitsForLimiter(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	conn := throttle.NewLimitedConnectionWithClock(zeroConn{},
+		throttle.NewLimiter(testLimit), clock)
+	buf := make([]byte, 4*testBurst)
+	// Read transfers no more than a burst at once
+	n, err := conn.Read(buf)
+	if err != nil || n != testBurst {
+		t.Fatalf("Read %d bytes (%v), expected %d", n, err, testBurst)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := conn.Read(buf); err != nil {
+			t.Error(err)
+		}
+	}()
+	waitPending(clock, 1)
+	clock.Advance(refill / 2)
+	assertBlocked(t, done)
+	clock.Advance(refill / 2)
+	waitDone(t, done)
+}
+
+func TestLimitedConnectionReadDeadline(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	conn := throttle.NewLimitedConnectionWithClock(zeroConn{},
+		throttle.NewLimiter(testLimit), clock)
+	buf := make([]byte, testBurst)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	// Data is read, but limiter wants connection to wait past deadline
+	conn.SetReadDeadline(clock.Now().Add(refill / 2))
+	n, err := conn.Read(buf)
+	if n != testBurst {
+		t.Fatalf("Read %d bytes, expected %d", n, testBurst)
+	}
+	if ne, ok := err.(interface{ Timeout() bool }); !ok || !ne.Timeout() {
+		t.Fatalf("Read failed with %v, expected timeout", err)
+	}
+	// Next read waits for what the previous one owes
+	conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := conn.Read(buf); err != nil {
+			t.Error(err)
+		}
+	}()
+	waitPending(clock, 1)
+	clock.Advance(refill)
+	// Having waited, read reserves its own burst and waits for it in turn
+	waitPending(clock, 1)
+	clock.Advance(refill - time.Millisecond)
+	assertBlocked(t, done)
+	clock.Advance(time.Millisecond)
+	waitDone(t, done)
+}
+
+func TestLimitedConnectionCloseInterruptsWait(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	conn := throttle.NewLimitedConnectionWithClock(discardConn{},
+		throttle.NewLimiter(testLimit), clock)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 2*testBurst))
+		errs <- err
+	}()
+	waitPending(clock, 1)
+	conn.Close()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Write succeeded on closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hasn't interrupted waiting for limiter")
+	}
+}
+
+func TestLimitedConnectionsShareLimiter(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	shared := throttle.NewLimiter(testLimit)
+	conns := make([]*throttle.LimitedConnection, 4)
+	for i := range conns {
+		conns[i] = throttle.NewLimitedConnectionWithClock(discardConn{}, shared, clock)
+	}
+	const size = 10 * testLimit
+	elapsed := writeAll(clock, conns, size, testBurst)
+	// Bucket starts full, the rest is paid for at the limit
+	expected := time.Duration(float64(len(conns)*size-testBurst) / testLimit * float64(time.Second))
+	if d := elapsed - expected; d < -refill || d > refill {
+		t.Fatalf("Writing took %v, expected %v", elapsed, expected)
+	}
+}
+
+func TestSetLimitTakesEffectAtGivenTime(t *testing.T) {
+	l := throttle.NewLimiter(testLimit)
+	l.Reserve(epoch, testBurst)
+	if err := throttle.SetLimit(l, epoch, 2*testLimit); err != nil {
+		t.Fatal(err)
+	}
+	// Bucket is still empty, it just refills twice as fast
+	assertAt(t, "Bytes are reserved", l.Reserve(epoch, testBurst), epoch.Add(refill/2))
+}
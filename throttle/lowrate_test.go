@@ -0,0 +1,122 @@
+package throttle_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/anton-dessiatov/throttlesocks/throttletest"
+)
+
+// stampConn is a net.Conn recording the moment every byte written to it
+// goes out by a clock
+type stampConn struct {
+	discardConn
+	clock *throttletest.ManualClock
+
+	mu    sync.Mutex
+	times []time.Duration
+}
+
+func (c *stampConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for range b {
+		c.times = append(c.times, c.clock.Now().Sub(epoch))
+	}
+	return len(b), nil
+}
+
+// assertPaced checks that k-th byte (counting from zero) was transferred
+// exactly when limiter allowed it: bucket starts with a single byte and
+// every next one takes 1/limit seconds to pay for
+func assertPaced(t *testing.T, limit string, times []time.Duration) {
+	t.Helper()
+	l, err := throttle.ParseRate(limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, at := range times {
+		expected := time.Duration(float64(k) / float64(l) * float64(time.Second))
+		if d := at - expected; d < -time.Millisecond || d > time.Millisecond {
+			t.Fatalf("At %s byte %d was transferred at %v, expected %v", limit, k, at, expected)
+		}
+	}
+}
+
+func TestLowRateWritesArePaced(t *testing.T) {
+	for _, limit := range []string{"10bps", "3bps"} {
+		l, err := throttle.ParseRate(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock := throttletest.NewManualClock(epoch)
+		inner := &stampConn{clock: clock}
+		conn := throttle.NewLimitedConnectionWithClock(inner, throttle.NewLimiter(l), clock)
+		writeAll(clock, []*throttle.LimitedConnection{conn}, 10, 10)
+		if len(inner.times) != 10 {
+			t.Fatalf("At %s written %d bytes, expected 10", limit, len(inner.times))
+		}
+		assertPaced(t, limit, inner.times)
+	}
+}
+
+func TestLowRateSharedLimiterIsPaced(t *testing.T) {
+	const limit = "10bps"
+	l, err := throttle.ParseRate(limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := throttletest.NewManualClock(epoch)
+	shared := throttle.NewLimiter(l)
+	inner := &stampConn{clock: clock}
+	conns := make([]*throttle.LimitedConnection, 3)
+	for i := range conns {
+		conns[i] = throttle.NewLimitedConnectionWithClock(inner, shared, clock)
+	}
+	writeAll(clock, conns, 4, 2)
+	if len(inner.times) != 12 {
+		t.Fatalf("Written %d bytes, expected 12", len(inner.times))
+	}
+	// Connections take turns, so bytes go out one by one
+	assertPaced(t, limit, inner.times)
+}
+
+func TestLowRateReadsArePaced(t *testing.T) {
+	const limit = "3bps"
+	l, err := throttle.ParseRate(limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := throttletest.NewManualClock(epoch)
+	conn := throttle.NewLimitedConnectionWithClock(zeroConn{}, throttle.NewLimiter(l), clock)
+	var times []time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 10)
+		for len(times) < 5 {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for i := 0; i < n; i++ {
+				times = append(times, clock.Now().Sub(epoch))
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			// Data is handed to reader once it's paid for
+			assertPaced(t, limit, times)
+			return
+		default:
+		}
+		if clock.Pending() > 0 {
+			clock.AdvanceToNext()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package throttle
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateWindow is the interval over which transferred bytes are accumulated
+// before being folded into the moving average
+const rateWindow = time.Second
+
+// rateAlpha is the weight of the most recent window in the moving average
+const rateAlpha = 0.5
+
+// rateMeter measures transfer rate as an exponentially weighted moving
+// average over rateWindow-sized windows
+type rateMeter struct {
+	mu          sync.Mutex
+	rate        float64
+	pending     int64
+	windowStart time.Time
+}
+
+// add accounts n bytes transferred at the given moment
+func (m *rateMeter) add(now time.Time, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	m.pending += int64(n)
+}
+
+// Rate returns smoothed rate in bytes per second as of the given moment
+func (m *rateMeter) Rate(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	return m.rate
+}
+
+// Folds all windows that have completed by 'now' into the average. Windows
+// without any traffic decay the rate towards zero.
+func (m *rateMeter) advance(now time.Time) {
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+		return
+	}
+	elapsed := now.Sub(m.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	windows := int64(elapsed / rateWindow)
+	sample := float64(m.pending) / rateWindow.Seconds()
+	m.rate += rateAlpha * (sample - m.rate)
+	m.rate *= math.Pow(1-rateAlpha, float64(windows-1))
+	m.pending = 0
+	m.windowStart = m.windowStart.Add(time.Duration(windows) * rateWindow)
+}
@@ -0,0 +1,109 @@
+package throttle
+
+import (
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LimitedPacketConn is a wrapper around net.PacketConn that limits the rate
+// of its ReadFrom and WriteTo operations. Unlike LimitedConnection it never
+// splits datagrams: whole datagram is transferred and then the connection
+// waits for as long as limiter requires.
+type LimitedPacketConn struct {
+	net.PacketConn
+
+	limiter   Limiter
+	clock     Clock
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+// NewLimitedPacketConn creates a LimitedPacketConn from net.PacketConn and a
+// limiter
+func NewLimitedPacketConn(inner net.PacketConn, limiter Limiter) *LimitedPacketConn {
+	return NewLimitedPacketConnWithClock(inner, limiter, SystemClock)
+}
+
+// NewLimitedPacketConnWithClock creates a LimitedPacketConn that takes time
+// from a given clock
+func NewLimitedPacketConnWithClock(inner net.PacketConn, limiter Limiter, clock Clock) *LimitedPacketConn {
+	return &LimitedPacketConn{
+		PacketConn: inner,
+		limiter:    limiter,
+		clock:      clock,
+		close:      make(chan struct{}),
+	}
+}
+
+// ReadFrom is an implementation of net.PacketConn.ReadFrom
+func (c *LimitedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if n > 0 && c.wait(n) {
+		return 0, nil, io.ErrClosedPipe
+	}
+	return n, addr, err
+}
+
+// WriteTo is an implementation of net.PacketConn.WriteTo
+func (c *LimitedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > 0 && c.wait(len(b)) {
+		return 0, io.ErrClosedPipe
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// SyscallConn is an implementation of syscall.Conn. It gives access to the
+// underlying socket bypassing the limiter, so it fails unless the inner
+// connection implements syscall.Conn.
+func (c *LimitedPacketConn) SyscallConn() (syscall.RawConn, error) {
+	return syscallConn(c.PacketConn)
+}
+
+// Close is an implementation of net.PacketConn.Close
+func (c *LimitedPacketConn) Close() error {
+	var res error
+	c.closeOnce.Do(func() {
+		close(c.close)
+		res = c.PacketConn.Close()
+	})
+	return res
+}
+
+// Waits until n bytes are allowed by limiter. Returns true if connection
+// was closed while waiting.
+func (c *LimitedPacketConn) wait(n int) bool {
+	now := c.clock.Now()
+	delay := reserveDelay(c.limiter, now, n)
+	if delay <= 0 {
+		return false
+	}
+	timer := c.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return false
+	case <-c.close:
+		return true
+	}
+}
+
+// reserveDelay reserves n bytes in limiter and returns how long to wait
+// before they may be transferred. Unlike Limiter.Reserve it accepts n
+// exceeding limiter burst by reserving it in burst-sized pieces.
+func reserveDelay(l Limiter, now time.Time, n int) time.Duration {
+	burst := l.Burst()
+	at := now
+	for n > 0 {
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		// Reservations are queued, so the last one is the latest
+		at = l.Reserve(now, chunk)
+		n -= chunk
+	}
+	return at.Sub(now)
+}
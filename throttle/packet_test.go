@@ -0,0 +1,98 @@
+package throttle_test
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/anton-dessiatov/throttlesocks/throttletest"
+)
+
+// countingPacketConn is a net.PacketConn that counts datagrams written to
+// it and drops them
+type countingPacketConn struct {
+	net.PacketConn
+	written int64
+}
+
+func (c *countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.AddInt64(&c.written, 1)
+	return len(b), nil
+}
+
+func (c *countingPacketConn) Close() error { return nil }
+
+func (c *countingPacketConn) datagrams() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// waitDatagrams waits until inner connection gets n datagrams
+func waitDatagrams(t *testing.T, inner *countingPacketConn, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for inner.datagrams() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Sent %d datagrams, expected %d", inner.datagrams(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimitedPacketConnPacesDatagrams(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	inner := &countingPacketConn{}
+	conn := throttle.NewLimitedPacketConnWithClock(inner, throttle.NewLimiter(testLimit), clock)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if _, err := conn.WriteTo(make([]byte, testBurst), nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	// First datagram goes out of the full bucket, every next one waits for
+	// the bucket to refill
+	waitDatagrams(t, inner, 1)
+	for sent := int64(1); sent < 3; sent++ {
+		waitPending(clock, 1)
+		clock.Advance(refill - time.Millisecond)
+		if inner.datagrams() != sent {
+			t.Fatalf("Datagram %d was sent before its delay passed", sent+1)
+		}
+		clock.Advance(time.Millisecond)
+		waitDatagrams(t, inner, sent+1)
+	}
+}
+
+func TestLimitedPacketConnDoesNotSplitDatagrams(t *testing.T) {
+	clock := throttletest.NewManualClock(epoch)
+	inner := &countingPacketConn{}
+	conn := throttle.NewLimitedPacketConnWithClock(inner, throttle.NewLimiter(testLimit), clock)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if _, err := conn.WriteTo(make([]byte, 4*testBurst), nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	// Datagram bigger than burst waits for what it exceeds the bucket by
+	// as a whole
+	waitPending(clock, 1)
+	clock.Advance(3*refill - time.Millisecond)
+	if inner.datagrams() != 0 {
+		t.Fatal("Datagram was sent before its delay passed")
+	}
+	clock.Advance(time.Millisecond)
+	waitDatagrams(t, inner, 1)
+	// Second one pays for itself in full
+	waitPending(clock, 1)
+	clock.Advance(4*refill - time.Millisecond)
+	if inner.datagrams() != 1 {
+		t.Fatal("Datagram was sent before its delay passed")
+	}
+	clock.Advance(time.Millisecond)
+	waitDatagrams(t, inner, 2)
+}
@@ -0,0 +1,100 @@
+package throttle
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// uom stands for Unit Of Measurement. Units are BITS per second, not bytes
+var uomSuffixes = []struct {
+	unit string
+	mul  int64
+	div  int64
+}{
+	// IPerf assumes that megabit per second is exactly 1000000 bits per second
+	// (not 1024 * 1024)
+	{unit: "Kbps", mul: 1000, div: 8},
+	{unit: "Mbps", mul: 1000 * 1000, div: 8},
+	{unit: "Gbps", mul: 1000 * 1000 * 1000, div: 8},
+	{unit: "Tbps", mul: 1000 * 1000 * 1000 * 1000, div: 8},
+	// tcptrack, on the other hand, uses <prefix>bytes per second where prefix
+	// is a power of 2, that's why I'm using powers of 1024 for bytes-per-second
+	// units
+	{unit: "KBps", mul: 1024, div: 1},
+	{unit: "MBps", mul: 1024 * 1024, div: 1},
+	{unit: "GBps", mul: 1024 * 1024 * 1024, div: 1},
+	{unit: "TBps", mul: 1024 * 1024 * 1024 * 1024, div: 1},
+	{unit: "bps", mul: 1, div: 8},
+	{unit: "Bps", mul: 1, div: 1},
+}
+
+// Tries to parse an UOM suffix from a string. Returns string stripped from that
+// suffix and a multiplier. If no suffix matches, returns string as is and 1 as
+// a multiplier.
+func parseSuffix(s string) (string, int64, int64) {
+	for _, v := range uomSuffixes {
+		if strings.HasSuffix(s, v.unit) {
+			return s[0 : len(s)-len(v.unit)], v.mul, v.div
+		}
+	}
+
+	return s, 1, 1
+}
+
+// parseNumber parses limit string to a number of units, multiplier and
+// divisor. Limits that don't fit int64 once multiplied are rejected with an
+// error wrapping strconv.ErrRange.
+func parseNumber(s string) (int64, int64, int64, error) {
+	numberString, mul, div := parseSuffix(s)
+	n, err := strconv.ParseInt(numberString, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, 0, 0, fmt.Errorf("Bandwidth limit %q is too large: %w", s, strconv.ErrRange)
+	}
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Failed to parse %q", s)
+	}
+	if n < 0 {
+		return 0, 0, 0, fmt.Errorf("Negative values are not accepted as a bandwidth limit (%q)", s)
+	}
+	if n > math.MaxInt64/mul {
+		return 0, 0, 0, fmt.Errorf("Bandwidth limit %q is too large: %w", s, strconv.ErrRange)
+	}
+	return n, mul, div, nil
+}
+
+// ParseLimit parses given limit string to bytes per second.
+func ParseLimit(s string) (int64, error) {
+	n, mul, div, err := parseNumber(s)
+	if err != nil {
+		return 0, err
+	}
+	return n * mul / div, nil
+}
+
+// ParseBandwidth parses given limit string to bytes per second like
+// ParseLimit does, but keeps fractions of a byte, so that rates below 8bps
+// and odd numbers of bits per second don't get rounded down (or to zero).
+func ParseBandwidth(s string) (rate.Limit, error) {
+	n, mul, div, err := parseNumber(s)
+	if err != nil {
+		return 0, err
+	}
+	return rate.Limit(float64(n*mul) / float64(div)), nil
+}
+
+// Unlimited is a limit string that disables rate limiting
+const Unlimited = "unlimited"
+
+// ParseRate parses given limit string to rate.Limit. Besides anything
+// accepted by ParseBandwidth it accepts Unlimited which results in rate.Inf.
+func ParseRate(s string) (rate.Limit, error) {
+	if s == Unlimited {
+		return rate.Inf, nil
+	}
+	return ParseBandwidth(s)
+}
@@ -0,0 +1,67 @@
+package throttle_test
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+func TestParseLimit(t *testing.T) {
+	for _, c := range []struct {
+		s         string
+		limit     int64
+		bandwidth rate.Limit
+		// err is set if s is rejected, tooLarge if that's because it
+		// doesn't fit
+		err      bool
+		tooLarge bool
+	}{
+		{s: "10", limit: 10, bandwidth: 10},
+		{s: "10Bps", limit: 10, bandwidth: 10},
+		{s: "10bps", limit: 1, bandwidth: 1.25},
+		{s: "3bps", limit: 0, bandwidth: 0.375},
+		{s: "10KBps", limit: 10 * 1024, bandwidth: 10 * 1024},
+		{s: "10Kbps", limit: 1250, bandwidth: 1250},
+		{s: "1MBps", limit: 1024 * 1024, bandwidth: 1024 * 1024},
+		{s: "1Mbps", limit: 125000, bandwidth: 125000},
+		{s: "1GBps", limit: 1024 * 1024 * 1024, bandwidth: 1024 * 1024 * 1024},
+		{s: "1Gbps", limit: 125000000, bandwidth: 125000000},
+		{s: "1TBps", limit: 1024 * 1024 * 1024 * 1024, bandwidth: 1024 * 1024 * 1024 * 1024},
+		{s: "1Tbps", limit: 125000000000, bandwidth: 125000000000},
+		{s: "9223372036854775807KBps", err: true, tooLarge: true},
+		{s: "99999999999999999999bps", err: true, tooLarge: true},
+		{s: "-1Mbps", err: true},
+		{s: "1.5Mbps", err: true},
+		{s: "Mbps", err: true},
+		{s: "10mbps", err: true},
+	} {
+		limit, err := throttle.ParseLimit(c.s)
+		if c.err {
+			if err == nil {
+				t.Errorf("ParseLimit(%q) is %d, expected an error", c.s, limit)
+			} else if tooLarge := errors.Is(err, strconv.ErrRange); tooLarge != c.tooLarge {
+				t.Errorf("ParseLimit(%q) fails with %v, range error expected: %v", c.s, err, c.tooLarge)
+			}
+			if _, err := throttle.ParseBandwidth(c.s); err == nil {
+				t.Errorf("ParseBandwidth(%q) succeeds, expected an error", c.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLimit(%q) fails: %v", c.s, err)
+			continue
+		}
+		if limit != c.limit {
+			t.Errorf("ParseLimit(%q) is %d, expected %d", c.s, limit, c.limit)
+		}
+		bandwidth, err := throttle.ParseBandwidth(c.s)
+		if err != nil {
+			t.Errorf("ParseBandwidth(%q) fails: %v", c.s, err)
+		} else if bandwidth != c.bandwidth {
+			t.Errorf("ParseBandwidth(%q) is %v, expected %v", c.s, bandwidth, c.bandwidth)
+		}
+	}
+}
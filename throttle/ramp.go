@@ -0,0 +1,114 @@
+package throttle
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rampLimiter is a per-connection Limiter that lets a connection start at a
+// low rate and grows its rate exponentially, much like TCP slow-start. All
+// traffic is charged to the next limiter as well. Once ramp is over, next
+// limiter is used alone.
+type rampLimiter struct {
+	ramp     *rate.Limiter
+	start    rate.Limit
+	end      rate.Limit
+	since    time.Time
+	duration time.Duration
+	next     Limiter
+	clock    Clock
+}
+
+// NewRampLimiter creates a Limiter whose rate grows from 'start' at 'since'
+// to 'end' once 'duration' elapses, after which only 'next' limits the
+// connection. If 'end' is no more than 'start', rate stays at 'start' for
+// the whole duration.
+func NewRampLimiter(start, end rate.Limit, since time.Time, duration time.Duration, next Limiter) Limiter {
+	return NewRampLimiterWithClock(start, end, since, duration, next, SystemClock)
+}
+
+// NewRampLimiterWithClock creates a ramp Limiter like NewRampLimiter does,
+// which tells burst size by time taken from a given clock
+func NewRampLimiterWithClock(start, end rate.Limit, since time.Time, duration time.Duration, next Limiter,
+	clock Clock) Limiter {
+	return &rampLimiter{
+		ramp:     rate.NewLimiter(start, GetGoodBurst(start)),
+		start:    start,
+		end:      end,
+		since:    since,
+		duration: duration,
+		next:     next,
+		clock:    clock,
+	}
+}
+
+// limitAt returns ramp rate at a given moment. It is rate.Inf once ramp is
+// over.
+func (r *rampLimiter) limitAt(now time.Time) rate.Limit {
+	elapsed := now.Sub(r.since)
+	if elapsed >= r.duration {
+		return rate.Inf
+	}
+	if elapsed <= 0 || r.end <= r.start || r.end == rate.Inf {
+		return r.start
+	}
+	growth := float64(r.end / r.start)
+	return r.start * rate.Limit(math.Pow(growth, float64(elapsed)/float64(r.duration)))
+}
+
+// update adjusts ramp limiter to a given moment and reports whether ramp is
+// still going on
+func (r *rampLimiter) update(now time.Time, n int) bool {
+	limit := r.limitAt(now)
+	if limit == rate.Inf {
+		return false
+	}
+	burst := GetGoodBurst(limit)
+	if burst < n {
+		burst = n
+	}
+	r.ramp.SetLimitAt(now, limit)
+	r.ramp.SetBurstAt(now, burst)
+	return true
+}
+
+func (r *rampLimiter) Burst() int {
+	res := r.next.Burst()
+	limit := r.limitAt(r.clock.Now())
+	if limit == rate.Inf {
+		return res
+	}
+	if burst := GetGoodBurst(limit); burst < res {
+		res = burst
+	}
+	return res
+}
+
+func (r *rampLimiter) AllowN(now time.Time, n int) bool {
+	if !r.update(now, n) {
+		return r.next.AllowN(now, n)
+	}
+	res := r.ramp.ReserveN(now, n)
+	if res.OK() && res.DelayFrom(now) == 0 && r.next.AllowN(now, n) {
+		return true
+	}
+	res.CancelAt(now)
+	return false
+}
+
+func (r *rampLimiter) Reserve(now time.Time, n int) time.Time {
+	if !r.update(now, n) {
+		return r.next.Reserve(now, n)
+	}
+	at := now.Add(r.ramp.ReserveN(now, n).DelayFrom(now))
+	if next := r.next.Reserve(now, n); next.After(at) {
+		at = next
+	}
+	return at
+}
+
+func (r *rampLimiter) release(now time.Time) {
+	release(r.next, now)
+}
@@ -0,0 +1,50 @@
+package throttle_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/anton-dessiatov/throttlesocks/throttletest"
+	"golang.org/x/time/rate"
+)
+
+func TestRampLimiterFollowsClock(t *testing.T) {
+	const start, end = rate.Limit(2 * 1024), rate.Limit(200 * 1024)
+	clock := throttletest.NewManualClock(epoch)
+	next := throttle.NewLimiter(end)
+	ramp := throttle.NewRampLimiterWithClock(start, throttle.LimitOf(next), clock.Now(), 10*time.Second, next, clock)
+	if burst := ramp.Burst(); burst != throttle.GetGoodBurst(start) {
+		t.Fatalf("Burst is %d at start, expected %d", burst, throttle.GetGoodBurst(start))
+	}
+	// Rate grows exponentially, so it's the geometric mean halfway through
+	clock.Advance(5 * time.Second)
+	if burst, expected := ramp.Burst(), throttle.GetGoodBurst(20*1024); burst != expected {
+		t.Fatalf("Burst is %d halfway, expected %d", burst, expected)
+	}
+	clock.Advance(5 * time.Second)
+	if burst := ramp.Burst(); burst != next.Burst() {
+		t.Fatalf("Burst is %d once ramp is over, expected %d", burst, next.Burst())
+	}
+}
+
+func TestLimitOf(t *testing.T) {
+	shared := throttle.NewLimiter(100 * 1024)
+	for _, c := range []struct {
+		name     string
+		limiter  throttle.Limiter
+		expected rate.Limit
+	}{
+		{"bucket", shared, 100 * 1024},
+		{"unlimited", throttle.NewLimiter(rate.Inf), rate.Inf},
+		{"floor", throttle.NewFloorLimiter(1024, 0, shared), 100 * 1024},
+		{"cap", throttle.NewCapLimiter(10*1024, shared), 10 * 1024},
+		{"loose cap", throttle.NewCapLimiter(1024*1024, shared), 100 * 1024},
+		{"batch", throttle.NewBatchLimiter(shared, 64*1024), 100 * 1024},
+		{"class", throttle.NewClassLimiter(10*1024, 50*1024, shared), 50 * 1024},
+	} {
+		if limit := throttle.LimitOf(c.limiter); limit != c.expected {
+			t.Errorf("Limit of %s is %v, expected %v", c.name, limit, c.expected)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package throttle
+
+import "time"
+
+// Trace describes a single reservation made by LimitedConnection
+type Trace struct {
+	Time time.Time
+	// Write is set for writes to the inner connection and unset for reads
+	Write bool
+	// Bytes is the number of transferred bytes reservation is made for
+	Bytes int
+	// Delay is the time connection has to wait before next transfer
+	Delay time.Duration
+	// Tokens is the number of bytes left in limiter bucket after
+	// reservation. It's negative if bytes were reserved in advance. Only
+	// valid if HasTokens is set, since not every limiter has a single
+	// bucket.
+	Tokens    float64
+	HasTokens bool
+}
+
+// tokenCounter is implemented by limiters able to tell their bucket level
+type tokenCounter interface {
+	TokensAt(t time.Time) float64
+}
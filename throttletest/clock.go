@@ -0,0 +1,156 @@
+package throttletest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+)
+
+// FastClock is a throttle.Clock whose timers fire immediately, moving its
+// time forward to their deadlines. Throttled transfers complete without
+// waiting while time observed through the clock advances just like it would
+// with a real clock, so rates can be measured with it.
+type FastClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFastClock creates FastClock starting at a given time
+func NewFastClock(start time.Time) *FastClock {
+	return &FastClock{now: start}
+}
+
+// Now is an implementation of throttle.Clock.Now
+func (c *FastClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer is an implementation of throttle.Clock.NewTimer
+func (c *FastClock) NewTimer(d time.Duration) throttle.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Timers of concurrent waiters are created at slightly different
+	// moments, so never go back in time
+	if at := c.now.Add(d); at.After(c.now) {
+		c.now = at
+	}
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return firedTimer(ch)
+}
+
+// firedTimer is a timer that has already fired
+type firedTimer chan time.Time
+
+func (t firedTimer) C() <-chan time.Time { return t }
+func (t firedTimer) Stop() bool          { return false }
+
+// ManualClock is a throttle.Clock that only moves when told to. Timers fire
+// once Advance moves the clock past their deadlines, which makes it possible
+// to check exactly when throttled transfers proceed.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock creates ManualClock starting at a given time
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now is an implementation of throttle.Clock.Now
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer is an implementation of throttle.Clock.NewTimer
+func (c *ManualClock) NewTimer(d time.Duration) throttle.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{clock: c, at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by a given duration and fires timers
+// whose deadlines have passed
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advanceLocked(c.now.Add(d))
+}
+
+// AdvanceToNext moves the clock forward to the earliest deadline of pending
+// timers and fires timers whose deadlines have passed. It reports false if
+// there are no pending timers.
+func (c *ManualClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return false
+	}
+	next := c.timers[0].at
+	for _, t := range c.timers[1:] {
+		if t.at.Before(next) {
+			next = t.at
+		}
+	}
+	// Timers are only pending while their deadlines are ahead of the clock
+	c.advanceLocked(next)
+	return true
+}
+
+// advanceLocked moves the clock to a given moment and fires timers whose
+// deadlines have passed
+func (c *ManualClock) advanceLocked(now time.Time) {
+	c.now = now
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Pending returns the number of timers that haven't fired yet. Tests use it
+// to wait until a transfer blocks on the limiter before advancing the clock.
+func (c *ManualClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// manualTimer is a timer of ManualClock
+type manualTimer struct {
+	clock *ManualClock
+	at    time.Time
+	ch    chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.ch }
+
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
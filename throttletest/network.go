@@ -0,0 +1,169 @@
+package throttletest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Network is an in-memory network of listeners that connections are dialed
+// to by address. It lets destinations of a test Server run without real
+// sockets.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*Listener
+	nextPort  int
+}
+
+// NewNetwork creates an empty Network
+func NewNetwork() *Network {
+	return &Network{listeners: make(map[string]*Listener), nextPort: 1}
+}
+
+// Listen creates a listener reachable at given address, which is any
+// host:port string (for example 'db.test:5432')
+func (n *Network) Listen(addr string) (*Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, fmt.Errorf("Address %s is already in use", addr)
+	}
+	l := &Listener{
+		network: n,
+		name:    addr,
+		addr:    fakeAddr(host, port),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects to a listener of the network. It has the signature of
+// net.Dialer.DialContext. Only "tcp" network is supported.
+func (n *Network) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("Network %q is not supported", network)
+	}
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	n.nextPort++
+	clientAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: n.nextPort}
+	n.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Connection to %s refused", addr)
+	}
+
+	client, server := newPipe(clientAddr, l.addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("Connection to %s refused", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Listener is an in-memory net.Listener of a Network
+type Listener struct {
+	network   *Network
+	name      string
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept is an implementation of net.Listener.Accept
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+// Close is an implementation of net.Listener.Close
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.name)
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+// Addr is an implementation of net.Listener.Addr
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// newPipe is like net.Pipe, but its ends have TCP addresses and support
+// half-close. SOCKS server only understands TCP addresses of destination
+// connections and relies on half-close to finish relaying.
+func newPipe(aAddr, bAddr net.Addr) (*pipeConn, *pipeConn) {
+	// Every direction has its own net.Pipe so that it can be closed
+	// independently
+	aWriter, bReader := net.Pipe()
+	bWriter, aReader := net.Pipe()
+	a := &pipeConn{reader: aReader, writer: aWriter, local: aAddr, remote: bAddr}
+	b := &pipeConn{reader: bReader, writer: bWriter, local: bAddr, remote: aAddr}
+	return a, b
+}
+
+// pipeConn is an end of a pipe created by newPipe
+type pipeConn struct {
+	reader net.Conn
+	writer net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.writer.Write(b) }
+func (c *pipeConn) LocalAddr() net.Addr         { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr        { return c.remote }
+
+// CloseWrite makes reads of the other end return io.EOF
+func (c *pipeConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *pipeConn) Close() error {
+	c.writer.Close()
+	return c.reader.Close()
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.reader.SetDeadline(t)
+	return c.writer.SetDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.writer.SetWriteDeadline(t)
+}
+
+// fakeAddr makes a TCP address for host and port. Host names are replaced
+// with loopback address.
+func fakeAddr(host, port string) net.Addr {
+	addr := &net.TCPAddr{IP: net.ParseIP(host)}
+	if addr.IP == nil {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	fmt.Sscan(port, &addr.Port)
+	return addr
+}
@@ -0,0 +1,198 @@
+// Package throttletest runs a throttling SOCKS5 server in memory so that
+// applications can be tested under a slow link without real sockets or
+// sleeps:
+//
+//	network := throttletest.NewNetwork()
+//	l, _ := network.Listen("backend.test:80")
+//	go http.Serve(l, handler)
+//
+//	srv, _ := throttletest.NewServer(throttletest.Options{
+//		Limit: "256Kbps",
+//		Clock: throttletest.NewFastClock(time.Now()),
+//		Dial:  network.Dial,
+//	})
+//	conn, _ := srv.Dial("tcp", "backend.test:80")
+package throttletest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/thinkgos/go-socks5"
+	"github.com/thinkgos/go-socks5/statute"
+	"golang.org/x/time/rate"
+)
+
+// Options configure a Server
+type Options struct {
+	// Limit is the bandwidth shared by all connections in the format of the
+	// -b flag (for example '256Kbps'). Unlimited if empty.
+	Limit string
+	// Limiter is used instead of Limit if set
+	Limiter throttle.Limiter
+	// Clock is used by limited connections. Defaults to throttle.SystemClock.
+	Clock throttle.Clock
+	// Dial connects to destinations. Defaults to net.Dialer.DialContext.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Server is an in-memory throttling SOCKS5 server
+type Server struct {
+	limiter throttle.Limiter
+	clock   throttle.Clock
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	socks   *socks5.Server
+
+	mu     sync.Mutex
+	conns  []*throttle.LimitedConnection
+	closed bool
+}
+
+// NewServer creates a Server
+func NewServer(opts Options) (*Server, error) {
+	s := &Server{
+		limiter: opts.Limiter,
+		clock:   opts.Clock,
+		dial:    opts.Dial,
+	}
+	if s.limiter == nil {
+		limit := rate.Inf
+		if opts.Limit != "" {
+			var err error
+			limit, err = throttle.ParseRate(opts.Limit)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.limiter = throttle.NewLimiter(limit)
+	}
+	if s.clock == nil {
+		s.clock = throttle.SystemClock
+	}
+	if s.dial == nil {
+		s.dial = (&net.Dialer{}).DialContext
+	}
+	s.socks = socks5.NewServer(
+		socks5.WithResolver(unresolvingResolver{}),
+		socks5.WithDial(s.dialLimited))
+	return s, nil
+}
+
+// Dials destination and limits resulting connection
+func (s *Server) dialLimited(ctx context.Context, network, addr string) (net.Conn, error) {
+	inner, err := s.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := throttle.NewLimitedConnectionWithClock(inner, s.limiter, s.clock)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return nil, fmt.Errorf("Server is closed")
+	}
+	s.conns = append(s.conns, conn)
+	return conn, nil
+}
+
+// DialProxy returns a connection to the SOCKS5 server itself. It's useful
+// for applications that speak SOCKS5 on their own.
+func (s *Server) DialProxy() (net.Conn, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, fmt.Errorf("Server is closed")
+	}
+	client, server := newPipe(fakeAddr("client.test", "0"), fakeAddr("proxy.test", "1080"))
+	go s.socks.ServeConn(server)
+	return client, nil
+}
+
+// Dial connects to addr through the server. Only "tcp" network is
+// supported.
+func (s *Server) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the server. It has the signature of
+// net.Dialer.DialContext. Only "tcp" network is supported.
+func (s *Server) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("Network %q is not supported", network)
+	}
+	dest, err := statute.ParseAddrSpec(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Bad destination %q: %w", addr, err)
+	}
+	conn, err := s.DialProxy()
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := handshake(conn, dest); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close closes all connections to destinations
+func (s *Server) Close() error {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.closed = true
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return nil
+}
+
+// Requests a connection to destination without authentication
+func handshake(conn net.Conn, dest statute.AddrSpec) error {
+	methods := []byte{statute.MethodNoAuth}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, methods).Bytes()); err != nil {
+		return err
+	}
+	method, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return err
+	}
+	if method.Method != statute.MethodNoAuth {
+		return statute.ErrNoSupportedAuth
+	}
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandConnect,
+		DstAddr: dest,
+	}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return err
+	}
+	reply, err := statute.ParseReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply.Response != statute.RepSuccess {
+		return fmt.Errorf("Connection to %v refused with reply code %d", dest.String(), reply.Response)
+	}
+	return nil
+}
+
+// unresolvingResolver leaves host names unresolved so that they are passed
+// to Options.Dial as is
+type unresolvingResolver struct{}
+
+func (unresolvingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
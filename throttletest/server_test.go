@@ -0,0 +1,124 @@
+package throttletest_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"github.com/anton-dessiatov/throttlesocks/throttletest"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// serveBytes makes a destination at addr that sends size bytes to every
+// connection and closes it
+func serveBytes(t *testing.T, network *throttletest.Network, addr string, size int) {
+	t.Helper()
+	l, err := network.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				c.Write(bytes.Repeat([]byte{'x'}, size))
+			}(c)
+		}
+	}()
+}
+
+func TestServerObservesLimit(t *testing.T) {
+	const limit = "256Kbps"
+	const size = 64000
+	l, err := throttle.ParseRate(limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := throttletest.NewNetwork()
+	serveBytes(t, network, "backend.test:80", size)
+	clock := throttletest.NewFastClock(epoch)
+	srv, err := throttletest.NewServer(throttletest.Options{
+		Limit: limit,
+		Clock: clock,
+		Dial:  network.Dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	conn, err := srv.Dial("tcp", "backend.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != size {
+		t.Fatalf("Received %d bytes, expected %d", len(data), size)
+	}
+	// Bucket starts full, the rest is paid for at the limit
+	elapsed := clock.Now().Sub(epoch)
+	expected := time.Duration(float64(size-throttle.GetGoodBurst(l)) / float64(l) * float64(time.Second))
+	if d := elapsed - expected; d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("Transfer took %v at %s, expected %v", elapsed, limit, expected)
+	}
+}
+
+func TestServerSharesLimitBetweenConnections(t *testing.T) {
+	const limit = "1Mbps"
+	const size = 125000
+	const conns = 4
+	l, err := throttle.ParseRate(limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := throttletest.NewNetwork()
+	serveBytes(t, network, "backend.test:80", size)
+	clock := throttletest.NewFastClock(epoch)
+	srv, err := throttletest.NewServer(throttletest.Options{
+		Limit: limit,
+		Clock: clock,
+		Dial:  network.Dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		go func() {
+			conn, err := srv.Dial("tcp", "backend.test:80")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			_, err = io.Copy(io.Discard, conn)
+			errs <- err
+		}()
+	}
+	for i := 0; i < conns; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Connections get the limit between them
+	elapsed := clock.Now().Sub(epoch)
+	expected := time.Duration(float64(conns*size-throttle.GetGoodBurst(l)) / float64(l) * float64(time.Second))
+	if d := elapsed - expected; d < -100*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("Transfers took %v at %s, expected %v", elapsed, limit, expected)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chained throttlesocks instances may talk over mutual TLS. Instead of
+// relying on a certificate authority, both sides pin certificates of their
+// peers by SHA-256 fingerprints of their DER encoding (as printed by
+// 'openssl x509 -noout -fingerprint -sha256').
+
+// certPins is a set of pinned certificate fingerprints
+type certPins map[[sha256.Size]byte]bool
+
+// parseCertPins parses comma-separated list of hex SHA-256 fingerprints.
+// Bytes may be separated by colons.
+func parseCertPins(s string) (certPins, error) {
+	res := make(certPins)
+	for _, pin := range strings.Split(s, ",") {
+		b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("Bad certificate fingerprint %q, expected hex SHA-256", pin)
+		}
+		var fp [sha256.Size]byte
+		copy(fp[:], b)
+		res[fp] = true
+	}
+	return res, nil
+}
+
+// verify is a tls.Config.VerifyPeerCertificate function accepting only
+// pinned leaf certificates
+func (p certPins) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("Peer hasn't presented a certificate")
+	}
+	if !p[sha256.Sum256(rawCerts[0])] {
+		return fmt.Errorf("Peer certificate %x is not pinned", sha256.Sum256(rawCerts[0]))
+	}
+	return nil
+}
+
+// serverTLSConfig creates TLS configuration of a listener that only accepts
+// peers presenting pinned client certificates. Certificate of the listener
+// is served by 'certs'.
+func serverTLSConfig(certs *certReloader, peerPins string) (*tls.Config, error) {
+	pins, err := parseCertPins(peerPins)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate:        certs.getCertificate,
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: pins.verify,
+		MinVersion:            tls.VersionTLS12,
+	}, nil
+}
+
+// clientTLSConfig creates TLS configuration for connecting to a peer
+// presenting pinned server certificate. If 'verifyCA' is set, peer
+// certificate is verified by certificate authorities for 'serverName'
+// instead, which suits peers with certificates obtained through ACME. Either
+// pins or CA verification is required, so that peer is never trusted by
+// accident.
+func clientTLSConfig(certFile, keyFile, peerPins string, verifyCA bool, serverName string) (*tls.Config, error) {
+	if peerPins != "" && verifyCA {
+		return nil, fmt.Errorf("Peer certificate is verified either by pins or by certificate authorities, not both")
+	}
+	if peerPins == "" && !verifyCA {
+		return nil, fmt.Errorf("Peer certificate has to be pinned or verified by certificate authorities")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if verifyCA {
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ServerName:   serverName,
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+	pins, err := parseCertPins(peerPins)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// Peer certificate is verified against pins instead of CA
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: pins.verify,
+		MinVersion:            tls.VersionTLS12,
+	}, nil
+}
+
+// tlsHandshakeTimeout limits how long accepted peers may take to complete
+// TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// newTLSListener is like tls.NewListener, but limits handshake time so that
+// clients that don't talk TLS don't hang around forever
+func newTLSListener(inner net.Listener, config *tls.Config) net.Listener {
+	return tlsListener{Listener: inner, config: config}
+}
+
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &handshakingConn{Conn: tls.Server(conn, l.config)}, nil
+}
+
+// handshakingConn performs TLS handshake with a deadline before the first
+// Read or Write
+type handshakingConn struct {
+	*tls.Conn
+	once sync.Once
+	err  error
+}
+
+func (c *handshakingConn) handshake() error {
+	c.once.Do(func() {
+		c.Conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		c.err = c.Conn.Handshake()
+		c.Conn.SetDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *handshakingConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *handshakingConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
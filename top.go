@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"golang.org/x/time/rate"
+)
+
+// topClient fetches live connections from admin API of a remote proxy
+type topClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// connections returns live connections served by /connections
+func (c topClient) connections() ([]connectionInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, c.base+"/connections", nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Admin API responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var res []connectionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("Failed to decode connections: %w", err)
+	}
+	return res, nil
+}
+
+// topOrders are orders connections may be listed in by top
+var topOrders = map[string]func(a, b connectionInfo) bool{
+	"rate": func(a, b connectionInfo) bool {
+		return a.ReadRate+a.WriteRate > b.ReadRate+b.WriteRate
+	},
+	"bytes": func(a, b connectionInfo) bool {
+		return a.BytesRead+a.BytesWritten > b.BytesRead+b.BytesWritten
+	},
+	"wait": func(a, b connectionInfo) bool {
+		return a.WaitTime > b.WaitTime
+	},
+	"age": func(a, b connectionInfo) bool {
+		return a.Created.Before(b.Created)
+	},
+}
+
+// runTop runs top mode: it polls admin API of a running proxy and renders
+// its live connections in the terminal until interrupted
+func runTop(args []string) {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	var addr = flags.String("addr", "", "Address of admin API of the proxy (for example 'proxy.example.com:3219'). May be an http:// or https:// URL")
+	var tenant = flags.String("tenant", "", "Name of a tenant to show connections of instead of all connections of the proxy")
+	var token = flags.String("token", "", "Admin token of the tenant")
+	var interval = flags.Duration("interval", 2*time.Second, "How often to refresh the table")
+	var order = flags.String("sort", "rate", "Order of connections: 'rate', 'bytes', 'wait' or 'age'")
+	var rows = flags.Int("n", 30, "Maximum number of connections to show")
+	var once = flags.Bool("once", false, "Print the table once and exit instead of refreshing it")
+	flags.Parse(args)
+
+	if *addr == "" {
+		log.Fatal("Please set addr")
+	}
+	less, ok := topOrders[*order]
+	if !ok {
+		log.Fatalf("Unknown sort order %q", *order)
+	}
+	if *interval <= 0 {
+		log.Fatal("Interval must be positive")
+	}
+	base := *addr
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		base = "http://" + base
+	}
+	base = strings.TrimSuffix(base, "/")
+	if *tenant != "" {
+		base += "/tenants/" + *tenant
+	}
+	c := topClient{base: base, token: *token, client: &http.Client{Timeout: 10 * time.Second}}
+
+	for {
+		conns, err := c.connections()
+		if *once {
+			if err != nil {
+				log.Fatal(err)
+			}
+			printTop(os.Stdout, *addr, conns, less, *rows)
+			return
+		}
+		// Clear the terminal and move cursor home before every refresh
+		fmt.Print("\x1b[H\x1b[2J")
+		if err != nil {
+			fmt.Printf("%s  %v\n", time.Now().Format("15:04:05"), err)
+		} else {
+			printTop(os.Stdout, *addr, conns, less, *rows)
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// printTop writes up to 'rows' connections ordered by 'less' as a table
+// headed by totals of all connections
+func printTop(out io.Writer, addr string, conns []connectionInfo, less func(a, b connectionInfo) bool, rows int) {
+	var readRate, writeRate float64
+	for _, c := range conns {
+		readRate += c.ReadRate
+		writeRate += c.WriteRate
+	}
+	fmt.Fprintf(out, "%s  %s  %d connections  read %s  written %s\n\n", time.Now().Format("15:04:05"),
+		addr, len(conns), formatRate(rate.Limit(readRate)), formatRate(rate.Limit(writeRate)))
+
+	sort.SliceStable(conns, func(i, j int) bool { return less(conns[i], conns[j]) })
+	if len(conns) > rows {
+		conns = conns[:rows]
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tCLIENT\tUSER\tDESTINATION\tAGE\tREAD\tWRITTEN\tREAD/S\tWRITE/S\tWAITED\n")
+	now := time.Now()
+	for _, c := range conns {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%.1fs\n", c.ID,
+			printable(c.Client), printable(c.Tag), printable(c.Destination),
+			now.Sub(c.Created).Round(time.Second), formatBytes(c.BytesRead), formatBytes(c.BytesWritten),
+			formatRate(rate.Limit(c.ReadRate)), formatRate(rate.Limit(c.WriteRate)), c.WaitTime)
+	}
+	w.Flush()
+}
+
+// printable returns s as is unless it has characters that aren't printable,
+// which includes control characters messing up the terminal. Such strings
+// are quoted with those characters escaped.
+func printable(s string) string {
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
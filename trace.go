@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+)
+
+// traceQueueSize is the number of events that may wait for a slow admin API
+// subscriber before further events get dropped
+const traceQueueSize = 1024
+
+// traceEvent is a JSON representation of a limiter reservation
+type traceEvent struct {
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	Destination string    `json:"destination"`
+	Time        time.Time `json:"time"`
+	// Direction is 'read' for data read from the destination and 'write'
+	// for data written to it
+	Direction string `json:"direction"`
+	Bytes     int    `json:"bytes"`
+	// Delay granted by limiter in seconds
+	Delay float64 `json:"delay"`
+	// Tokens is limiter bucket level after reservation if it's known
+	Tokens *float64 `json:"tokens,omitempty"`
+}
+
+// limiterTracer passes reservations made by connections to the log and to
+// admin API subscribers
+type limiterTracer struct {
+	// subscribed is the number of admin API subscribers. Reservations
+	// aren't turned into events while there are none and tracer doesn't
+	// log, since tracer is enabled whenever admin API is.
+	subscribed int32
+	log        bool
+
+	mu   sync.Mutex
+	subs map[chan traceEvent]struct{}
+}
+
+func newLimiterTracer(log bool) *limiterTracer {
+	return &limiterTracer{log: log, subs: make(map[chan traceEvent]struct{})}
+}
+
+// connTracer returns a tracer of a registered connection
+func (t *limiterTracer) connTracer(id uint64, meta connMeta) func(throttle.Trace) {
+	destination := net.JoinHostPort(meta.host, strconv.Itoa(meta.port))
+	return func(r throttle.Trace) {
+		if !t.log && atomic.LoadInt32(&t.subscribed) == 0 {
+			return
+		}
+		e := traceEvent{
+			ID:          id,
+			Client:      meta.client,
+			Destination: destination,
+			Time:        r.Time,
+			Direction:   "read",
+			Bytes:       r.Bytes,
+			Delay:       r.Delay.Seconds(),
+		}
+		if r.Write {
+			e.Direction = "write"
+		}
+		if r.HasTokens {
+			tokens := r.Tokens
+			e.Tokens = &tokens
+		}
+		t.publish(e)
+	}
+}
+
+func (t *limiterTracer) publish(e traceEvent) {
+	if t.log {
+		tokens := "unknown"
+		if e.Tokens != nil {
+			tokens = strconv.FormatFloat(*e.Tokens, 'f', 0, 64)
+		}
+		log.Printf("Connection %d from %s to %s: %s %d bytes, delay %v, tokens %s", e.ID, e.Client,
+			e.Destination, e.Direction, e.Bytes, time.Duration(e.Delay*float64(time.Second)), tokens)
+	}
+	if atomic.LoadInt32(&t.subscribed) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sub := range t.subs {
+		select {
+		case sub <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns channel receiving events until returned function is
+// called
+func (t *limiterTracer) subscribe() (<-chan traceEvent, func()) {
+	ch := make(chan traceEvent, traceQueueSize)
+	t.mu.Lock()
+	t.subs[ch] = struct{}{}
+	atomic.AddInt32(&t.subscribed, 1)
+	t.mu.Unlock()
+	return ch, func() {
+		t.mu.Lock()
+		if _, ok := t.subs[ch]; ok {
+			delete(t.subs, ch)
+			atomic.AddInt32(&t.subscribed, -1)
+		}
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anton-dessiatov/throttlesocks/throttle"
+	"golang.org/x/time/rate"
+)
+
+// udpSessionTimeout is how long a UDP forward keeps state for a client that
+// doesn't send or receive anything
+const udpSessionTimeout = 2 * time.Minute
+
+// maxDatagramSize is the size of buffers used to relay datagrams
+const maxDatagramSize = 64 * 1024
+
+// udpSessionQueue is the number of datagrams from a client that may wait
+// for the limiter before more of them get dropped
+const udpSessionQueue = 64
+
+// serveUDPForward relays datagrams received on forward's socket to its
+// target and replies back to their senders. Every client address gets its
+// own socket towards the target. Both directions are limited by a single
+// limiter shared by all clients unless proxy only monitors traffic. Every
+// client waits for the limiter on its own, so that receiving datagrams of
+// others isn't held up.
+func (p *proxy) serveUDPForward(pc net.PacketConn, f forward) error {
+	limiter := f.limiter
+	if limiter == nil {
+		limiter = p.limiter
+	}
+	if p.monitor {
+		limiter = throttle.NewLimiter(rate.Inf)
+	}
+	defer pc.Close()
+
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		key := client.String()
+		mu.Lock()
+		session, ok := sessions[key]
+		if !ok {
+			conn, err := net.Dial("udp", f.target)
+			if err != nil {
+				mu.Unlock()
+				log.Printf("Failed to forward datagram from %s to %s: %v", key, f.target, err)
+				continue
+			}
+			session = &udpSession{
+				conn:  throttle.NewLimitedPacketConn(udpSessionConn{Conn: conn, link: p.link}, limiter),
+				queue: make(chan []byte, udpSessionQueue),
+			}
+			sessions[key] = session
+			go forwardDatagrams(session, key, f.target)
+			go func() {
+				relayReplies(pc, session.conn, client, p.link)
+				mu.Lock()
+				delete(sessions, key)
+				close(session.queue)
+				mu.Unlock()
+			}()
+		}
+		session.conn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		select {
+		case session.queue <- append([]byte(nil), buf[:n]...):
+		default:
+			// Client sends faster than it's allowed to, so datagram is
+			// dropped as if socket buffer overflowed
+		}
+		mu.Unlock()
+	}
+}
+
+// udpSession is the state UDP forward keeps for a client
+type udpSession struct {
+	// conn is the socket towards the target
+	conn *throttle.LimitedPacketConn
+	// queue holds datagrams from the client waiting for the limiter
+	queue chan []byte
+}
+
+// Sends datagrams from a client queued for a session to the target as
+// limiter allows until queue is closed
+func forwardDatagrams(session *udpSession, client, target string) {
+	for datagram := range session.queue {
+		if _, err := session.conn.WriteTo(datagram, nil); err != nil {
+			log.Printf("Failed to forward datagram from %s to %s: %v", client, target, err)
+		}
+	}
+}
+
+// Relays datagrams received on session back to the client until session
+// times out or listener gets closed
+func relayReplies(l net.PacketConn, session *throttle.LimitedPacketConn, client net.Addr, lnk link) {
+	defer session.Close()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := session.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		session.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		if !lnk.enabled() {
+			if _, err := l.WriteTo(buf[:n], client); err != nil {
+				return
+			}
+			continue
+		}
+		datagram := append([]byte(nil), buf[:n]...)
+		lnk.deliver(func() {
+			l.WriteTo(datagram, client)
+		})
+	}
+}
+
+// udpSessionConn is a net.PacketConn of a socket connected to the target
+// of a UDP forward. Datagrams written to it are delivered through the link.
+type udpSessionConn struct {
+	net.Conn
+	link link
+}
+
+func (c udpSessionConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo ignores address, since socket is connected
+func (c udpSessionConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	if !c.link.enabled() {
+		return c.Write(b)
+	}
+	datagram := append([]byte(nil), b...)
+	c.link.deliver(func() {
+		c.Write(datagram)
+	})
+	return len(b), nil
+}
@@ -0,0 +1,116 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeReadyTimeout is how long the old process waits for a new one to
+// take over listeners before giving up on the upgrade
+const upgradeReadyTimeout = 30 * time.Second
+
+// handleUpgrades performs a graceful upgrade upon SIGUSR2: it starts a new
+// process from the current executable, hands listening sockets over to it,
+// stops accepting and exits once connections of all registries are drained
+func handleUpgrades(listeners *listenerSet, registries []*connRegistry) {
+	count := func() int {
+		res := 0
+		for _, r := range registries {
+			res += r.count()
+		}
+		return res
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			log.Printf("Upgrading")
+			if err := listeners.handOver(); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+				continue
+			}
+			listeners.closeAll()
+			log.Printf("New process has taken over, draining %d connections", count())
+			for count() > 0 {
+				time.Sleep(time.Second)
+			}
+			log.Printf("All connections are drained, exiting")
+			os.Exit(0)
+		}
+	}()
+}
+
+// Starts a new process passing listening sockets to it and waits until it
+// reports readiness
+func (s *listenerSet) handOver() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	keys := append([]string(nil), s.keys...)
+	var files []*os.File
+	for _, l := range s.files {
+		f, err := l.File()
+		if err != nil {
+			s.mu.Unlock()
+			closeFiles(files)
+			return err
+		}
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+	defer closeFiles(files)
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(keys, ";"),
+		fmt.Sprintf("%s=%d", readyFDEnv, firstInheritedFD+len(files)))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = fmt.Errorf("new process exited before taking over")
+		}
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		return err
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process hasn't taken over in %v", upgradeReadyTimeout)
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,6 @@
+package main
+
+// handleUpgrades does nothing since graceful upgrades rely on passing file
+// descriptors to a child process, which Windows doesn't support
+func handleUpgrades(listeners *listenerSet, registries []*connRegistry) {
+}